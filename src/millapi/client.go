@@ -2,55 +2,93 @@ package mill
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
 	"net/http"
 	"net/url"
-	"os"
+	"strconv"
+	"time"
 
-	"github.com/thingsplex/mill/model"
-
-	"github.com/futurehomeno/fimpgo"
-	"github.com/futurehomeno/fimpgo/utils"
 	log "github.com/sirupsen/logrus"
 )
 
 const (
 	// DefaultBaseURL is mill api url
-	baseURL = "https://api.millheat.com/"
-	// applyAccessTokenURL is mill api to get access_token and refresh_token
-	applyAccessTokenURL = baseURL + "share/applyAccessToken"
-	// authURL is mill api to get authorization_code
-	authURL = baseURL + "share/applyAuthCode"
-	// refreshURL is mill api to update access_token and refresh_token
-	refreshURL = baseURL + "share/refreshtoken?refreshtoken="
-
-	// deviceControlForOpenApiURL is mill api to controll individual devices
-	deviceControlURL = baseURL + "uds/deviceControlForOpenApi"
-	// getIndependentDevicesURL is mill api to get list of devices in unassigned room
-	getIndependentDevicesURL = baseURL + "uds/getIndependentDevices"
-	// selectDevicebyRoomURL is mill api to search device list by room
-	selectDevicebyRoomURL = baseURL + "uds/selectDevicebyRoom"
-	// selectHomeListURL is mill api to search housing list
-	selectHomeListURL = baseURL + "uds/selectHomeList"
-	// selectRoombyHomeURL is mill api to search room list by home
-	selectRoombyHomeURL = baseURL + "uds/selectRoombyHome"
+	DefaultBaseURL = "https://api.millheat.com/"
+	// DefaultPartnerURL is the Futurehome partner api url, used to get authorization codes
+	DefaultPartnerURL = "https://partners.futurehome.io/"
+	// DefaultTimeout is the default per-request timeout
+	DefaultTimeout = 30 * time.Second
+	// DefaultUserAgent is sent with every request unless overridden
+	DefaultUserAgent = "thingsplex-mill"
+	// DefaultSetpointResolution is the setpoint step in C for device models which are neither configured
+	// nor listed in DefaultSetpointResolutions
+	DefaultSetpointResolution = 1.0
+	// MinSetpoint is the lowest setpoint in C Mill heaters accept
+	MinSetpoint = 5.0
+	// DefaultMaxSetpoint is the highest setpoint in C for devices which don't report maxTemperature
+	DefaultMaxSetpoint = 35.0
+
+	// applyAccessTokenPath is mill api to get access_token and refresh_token
+	applyAccessTokenPath = "share/applyAccessToken"
+	// refreshPath is mill api to update access_token and refresh_token
+	refreshPath = "share/refreshtoken"
+
+	// deviceControlPath is mill api to controll individual devices
+	deviceControlPath = "uds/deviceControlForOpenApi"
+	// changeRoomModeTempInfoPath is mill api to change the comfort, sleep and away temperatures of a room
+	changeRoomModeTempInfoPath = "uds/changeRoomModeTempInfo"
+	// holidayConfigurationPath is mill api to start or cancel holiday mode of a home
+	holidayConfigurationPath = "uds/holidayChomeConfiguration"
+	// changeHomeModePath is mill api to force the mode of a home for a while
+	changeHomeModePath = "uds/changeHomeMode"
+	// getIndependentDevicesPath is mill api to get list of devices in unassigned room
+	getIndependentDevicesPath = "uds/getIndependentDevices"
+	// selectDevicebyRoomPath is mill api to search device list by room
+	selectDevicebyRoomPath = "uds/selectDevicebyRoom"
+	// selectHomeListPath is mill api to search housing list
+	selectHomeListPath = "uds/selectHomeList"
+	// selectRoombyHomePath is mill api to search room list by home
+	selectRoombyHomePath = "uds/selectRoombyHome"
+
+	// partnerAuthCodePath is partner api to get a mill authorization_code
+	partnerAuthCodePath = "api/control/edge/proxy/custom/auth-code"
+)
+
+// DefaultSetpointResolutions are the setpoint steps in C of device models known to accept half degrees,
+// keyed by subDomainId. Resolutions set with WithSetpointResolutions take precedence.
+var DefaultSetpointResolutions = map[int]float64{
+	5332: 0.5,
+	5333: 0.5,
+	6933: 0.5,
+}
+
+// Endpoint names as reported in APIError.Endpoint
+const (
+	EndpointApplyAccessToken      = "applyAccessToken"
+	EndpointRefreshToken          = "refreshtoken"
+	EndpointDeviceControl         = "deviceControlForOpenApi"
+	EndpointChangeRoomTemps       = "changeRoomModeTempInfo"
+	EndpointHolidayConfiguration  = "holidayChomeConfiguration"
+	EndpointChangeHomeMode        = "changeHomeMode"
+	EndpointGetIndependentDevices = "getIndependentDevices"
+	EndpointSelectDevicebyRoom    = "selectDevicebyRoom"
+	EndpointSelectHomeList        = "selectHomeList"
+	EndpointSelectRoombyHome      = "selectRoombyHome"
+	EndpointPartnerAuthCode       = "partner auth-code"
 )
 
-// Config is used to specify credential to Mill API
-// AccessKey : Access Key from api registration at http://api.millheat.com. Key is sent to mail.
-// SecretToken: Secret Token from api registration at http://api.millheat.com. Token is sent to mail.
-// Username: Your mill app account username
-// Password: Your mill app account password
+// Config is the response holder for token and control requests
 type Config struct {
 	ErrorCode  int    `json:"errorCode"`
 	Message    string `json:"message"`
 	StatusCode int    `json:"statusCode"`
 	Success    bool   `json:"success"`
 
-	Password string `json:"password"`
-	Username string `json:"username"`
-
 	Data struct {
 		AuthorizationCode string `json:"authorization_code"`
 		AccessToken       string `json:"access_token"`
@@ -60,10 +98,8 @@ type Config struct {
 	} `json:"data"`
 }
 
-// Client to make request to Mill API
-type Client struct {
-	httpResponse *http.Response
-
+// listResponse is the response holder for list requests. Every request decodes into its own value.
+type listResponse struct {
 	Data struct {
 		Homes              []Home   `json:"homeList"`
 		Rooms              []Room   `json:"roomList"`
@@ -72,6 +108,106 @@ type Client struct {
 	} `json:"data"`
 }
 
+// Client to make request to Mill API. A Client is safe for concurrent use.
+type Client struct {
+	httpClient   *http.Client
+	baseURL      string
+	partnerURL   string
+	timeout      time.Duration
+	userAgent    string
+	retryPolicy  RetryPolicy
+	crawlWorkers int
+	observer     func(endpoint string, err error)
+	resolutions  map[int]float64
+}
+
+// Option configures a Client created by New
+type Option func(*Client)
+
+// WithHTTPClient sets the http client used for all requests. Defaults to http.DefaultClient.
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = httpClient
+	}
+}
+
+// WithBaseURL points the client at another Mill API host, e.g. a proxy or a fake server
+func WithBaseURL(baseURL string) Option {
+	return func(c *Client) {
+		c.baseURL = withTrailingSlash(baseURL)
+	}
+}
+
+// WithPartnerURL sets the Futurehome partner api host used by GetAuthCode
+func WithPartnerURL(partnerURL string) Option {
+	return func(c *Client) {
+		c.partnerURL = withTrailingSlash(partnerURL)
+	}
+}
+
+// WithTimeout sets the per-request timeout. Zero disables it.
+func WithTimeout(timeout time.Duration) Option {
+	return func(c *Client) {
+		c.timeout = timeout
+	}
+}
+
+// WithUserAgent sets the User-Agent header sent with every request
+func WithUserAgent(userAgent string) Option {
+	return func(c *Client) {
+		c.userAgent = userAgent
+	}
+}
+
+// WithRetryPolicy sets how failed requests are retried
+func WithRetryPolicy(policy RetryPolicy) Option {
+	return func(c *Client) {
+		c.retryPolicy = policy
+	}
+}
+
+// WithCrawlWorkers sets how many requests GetAllDevices runs in parallel
+func WithCrawlWorkers(workers int) Option {
+	return func(c *Client) {
+		if workers > 0 {
+			c.crawlWorkers = workers
+		}
+	}
+}
+
+// WithRequestObserver sets a function called with the result of every request, after all retries.
+// err is nil on success. The function is called from the goroutine making the request.
+func WithRequestObserver(observer func(endpoint string, err error)) Option {
+	return func(c *Client) {
+		c.observer = observer
+	}
+}
+
+// WithSetpointResolutions sets the setpoint step in C which each device model accepts, keyed by subDomainId.
+// Models which are not listed use DefaultSetpointResolutions, or DefaultSetpointResolution.
+func WithSetpointResolutions(resolutions map[int]float64) Option {
+	return func(c *Client) {
+		c.resolutions = resolutions
+	}
+}
+
+// New creates a Mill API client
+func New(opts ...Option) *Client {
+	c := &Client{
+		httpClient:   http.DefaultClient,
+		baseURL:      DefaultBaseURL,
+		partnerURL:   DefaultPartnerURL,
+		timeout:      DefaultTimeout,
+		userAgent:    DefaultUserAgent,
+		retryPolicy:  DefaultRetryPolicy,
+		crawlWorkers: DefaultCrawlWorkers,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
 // Device is a mill heater
 type Device struct {
 	MaxTemperature       int     `json:"maxTemperature"`
@@ -87,9 +223,31 @@ type Device struct {
 	SubDomainID          int     `json:"subDomainId"`
 	ControlType          int     `json:"controlType"`
 	CurrentTemp          float32 `json:"currentTemp"`
-	SetpointTemp         int64   `json:"holidayTemp"`
+	SetpointTemp         float64 `json:"holidayTemp"` // hold temperature, only set for independent devices and devices with a hold
+}
+
+// CanSetTemp reports whether Mill allows changing the setpoint of the device
+func (d Device) CanSetTemp() bool {
+	return d.CanChangeTemp != 0
 }
 
+// SetpointRange returns the lowest and highest setpoint in C the device accepts
+func (d Device) SetpointRange() (float64, float64) {
+	if d.MaxTemperature > 0 {
+		return MinSetpoint, float64(d.MaxTemperature)
+	}
+	return MinSetpoint, DefaultMaxSetpoint
+}
+
+// Modes reported in Home.CurrentMode and Room.CurrentMode
+const (
+	ModeProgram = 0 // following the weekly program
+	ModeComfort = 1
+	ModeSleep   = 2
+	ModeAway    = 3
+	ModeOff     = 4
+)
+
 type Home struct {
 	HomeName         string      `json:"homeName"`
 	IsHoliday        int         `json:"isHoliday"`
@@ -129,223 +287,226 @@ type Room struct {
 	IsOffline            int           `json:"isOffline"`
 }
 
-// NewClient create a handle authentication to Mill API
-func (config *Config) NewClient(authCode string, password string, username string) (string, string, int64, int64) {
-	urlpassword := url.QueryEscape(password)
-	urlusername := url.QueryEscape(username)
-	url := applyAccessTokenURL + "?password=" + urlpassword + "&username=" + urlusername
-	req, err := http.NewRequest("POST", url, nil)
-	if err != nil {
-		// handle err
-		log.Error(fmt.Errorf("Can't post accessToken request, error: ", err))
+// SetpointRange returns the lowest and highest room temperature in C
+func (r Room) SetpointRange() (float64, float64) {
+	if r.MaxTemperature > 0 {
+		return MinSetpoint, float64(r.MaxTemperature)
 	}
-	req.Header.Set("Accept", "*/*")
-	req.Header.Set("Authorization_code", authCode)
-
-	resp, err := http.DefaultClient.Do(req)
-	processHTTPResponse(resp, err, config)
+	return MinSetpoint, DefaultMaxSetpoint
+}
 
-	accessToken := config.Data.AccessToken
-	refreshToken := config.Data.RefreshToken
-	expireTime := config.Data.ExpireTime
-	refreshExpireTime := config.Data.RefreshExpireTime
-	if err != nil {
-		return "", "", 0, 0
-	}
-	defer resp.Body.Close()
-	return accessToken, refreshToken, expireTime, refreshExpireTime
+// ModeTemp returns the room temperature in C for a mode. Off has no temperature, and neither has ModeProgram,
+// since Mill doesn't report which period of the weekly program is active.
+func (r Room) ModeTemp(mode int) (float64, bool) {
+	switch mode {
+	case ModeComfort:
+		return float64(r.ComfortTemp), r.ComfortTemp != 0
+	case ModeSleep:
+		return float64(r.SleepTemp), r.SleepTemp != 0
+	case ModeAway:
+		return float64(r.AwayTemp), r.AwayTemp != 0
+	}
+	return 0, false
 }
 
-func (config *Config) RefreshToken(refreshToken string) (string, string, int64, int64, error) {
-	url := fmt.Sprintf("%s%s", refreshURL, refreshToken)
-	req, err := http.NewRequest("POST", url, nil)
-	if err != nil {
-		// handle err
-		log.Error(fmt.Errorf("Can't post refreshToken request, error: ", err))
-	}
-	req.Header.Set("Accept", "*/*")
+// GetAccessToken exchanges an authorization code and user credentials for a new set of tokens
+func (c *Client) GetAccessToken(ctx context.Context, authCode string, password string, username string) (string, string, int64, int64, error) {
+	query := url.Values{}
+	query.Set("password", password)
+	query.Set("username", username)
+	header := http.Header{}
+	header.Set("Authorization_code", authCode)
 
-	resp, err := http.DefaultClient.Do(req)
-	if processHTTPResponse(resp, err, config) != nil {
-		return config.Data.AccessToken, config.Data.RefreshToken, config.Data.ExpireTime, config.Data.RefreshExpireTime, err
+	config := Config{}
+	if err := c.post(ctx, EndpointApplyAccessToken, applyAccessTokenPath, query, header, &config); err != nil {
+		return "", "", 0, 0, err
 	}
+	if config.Data.AccessToken == "" {
+		return "", "", 0, 0, &APIError{Endpoint: EndpointApplyAccessToken, StatusCode: http.StatusOK, Message: "no access token in response", kind: ErrInvalidCredentials}
+	}
+	return config.Data.AccessToken, config.Data.RefreshToken, config.Data.ExpireTime, config.Data.RefreshExpireTime, nil
+}
 
-	accessToken := config.Data.AccessToken
-	newRefreshToken := config.Data.RefreshToken
-	expireTime := config.Data.ExpireTime
-	refreshExpireTime := config.Data.RefreshExpireTime
+// RefreshToken gets a new access token and refresh token
+func (c *Client) RefreshToken(ctx context.Context, refreshToken string) (string, string, int64, int64, error) {
+	query := url.Values{}
+	query.Set("refreshtoken", refreshToken)
 
-	defer resp.Body.Close()
-	return accessToken, newRefreshToken, expireTime, refreshExpireTime, nil
+	config := Config{}
+	if err := c.post(ctx, EndpointRefreshToken, refreshPath, query, nil, &config); err != nil {
+		return "", "", 0, 0, err
+	}
+	if config.Data.AccessToken == "" {
+		return "", "", 0, 0, &APIError{Endpoint: EndpointRefreshToken, StatusCode: http.StatusOK, Message: "no access token in response", kind: ErrTokenExpired}
+	}
+	return config.Data.AccessToken, config.Data.RefreshToken, config.Data.ExpireTime, config.Data.RefreshExpireTime, nil
 }
 
-func (c *Client) GetAllDevices(accessToken string) ([]Device, []Room, []Home, []Device, error) {
-	homes, err := c.GetHomeList(accessToken)
-	var allDevices []Device
-	var allRooms []Room
-	var allHomes []Home
-	var allIndependentDevices []Device
-	if err != nil {
-		// handle err
-		log.Error(fmt.Errorf("Can't get home list, error: ", err))
-	}
-	for home := range homes.Data.Homes {
-		allHomes = append(allHomes, homes.Data.Homes[home])
-		rooms, err := c.GetRoomList(accessToken, homes.Data.Homes[home].HomeID)
-		if err != nil {
-			// handle err
-			log.Error(fmt.Errorf("Can't get room list, error: ", err))
-		}
-		for room := range rooms.Data.Rooms {
-			allRooms = append(allRooms, rooms.Data.Rooms[room])
-			devices, err := c.GetDeviceList(accessToken, rooms.Data.Rooms[room].RoomID)
-			for device := range devices.Data.Devices {
-				allDevices = append(allDevices, devices.Data.Devices[device])
-			}
-			if err != nil {
-				// handle err
-				log.Error(fmt.Errorf("Can't get device list, error: ", err))
-			}
-		}
-		// Get all independent devices
-		independentDevices, err := c.GetIndependentDevices(accessToken, homes.Data.Homes[home].HomeID)
-		if err != nil {
-			// handle err
-			log.Error(fmt.Errorf("Can't get independent device list, error: ", err))
-		}
-		for device := range independentDevices.Data.IndependentDevices {
-			allDevices = append(allDevices, independentDevices.Data.IndependentDevices[device])
-			allIndependentDevices = append(allIndependentDevices, independentDevices.Data.IndependentDevices[device])
-		}
+// GetHomeList returns the homes connected to the user
+func (c *Client) GetHomeList(ctx context.Context, accessToken string) ([]Home, error) {
+	resp := listResponse{}
+	if err := c.post(ctx, EndpointSelectHomeList, selectHomeListPath, nil, tokenHeader(accessToken), &resp); err != nil {
+		return nil, err
 	}
-	return allDevices, allRooms, allHomes, allIndependentDevices, nil
+	return resp.Data.Homes, nil
 }
 
-// GetHomeList sends curl request to get list of homes connected to user
-func (c *Client) GetHomeList(accessToken string) (*Client, error) {
-	req, err := http.NewRequest("POST", selectHomeListURL, nil)
-	if err != nil {
-		// handle err
-		log.Error(fmt.Errorf("Can't get home list, error: ", err))
+// GetRoomList returns the rooms of a home
+func (c *Client) GetRoomList(ctx context.Context, accessToken string, homeID int64) ([]Room, error) {
+	query := url.Values{}
+	query.Set("homeId", strconv.FormatInt(homeID, 10))
+	resp := listResponse{}
+	if err := c.post(ctx, EndpointSelectRoombyHome, selectRoombyHomePath, query, tokenHeader(accessToken), &resp); err != nil {
+		return nil, err
 	}
-	req.Header.Set("Accept", "*/*")
-	req.Header.Set("Access_token", accessToken)
+	return resp.Data.Rooms, nil
+}
 
-	resp, err := http.DefaultClient.Do(req)
-	processHTTPResponse(resp, err, c)
+// GetDeviceList returns the devices in a room
+func (c *Client) GetDeviceList(ctx context.Context, accessToken string, roomID int64) ([]Device, error) {
+	query := url.Values{}
+	query.Set("roomId", strconv.FormatInt(roomID, 10))
+	resp := listResponse{}
+	if err := c.post(ctx, EndpointSelectDevicebyRoom, selectDevicebyRoomPath, query, tokenHeader(accessToken), &resp); err != nil {
+		return nil, err
+	}
+	return resp.Data.Devices, nil
+}
 
-	return c, nil
+// GetIndependentDevices returns the devices of a home which are not assigned to a room
+func (c *Client) GetIndependentDevices(ctx context.Context, accessToken string, homeId int64) ([]Device, error) {
+	query := url.Values{}
+	query.Set("homeId", strconv.FormatInt(homeId, 10))
+	resp := listResponse{}
+	if err := c.post(ctx, EndpointGetIndependentDevices, getIndependentDevicesPath, query, tokenHeader(accessToken), &resp); err != nil {
+		return nil, err
+	}
+	return resp.Data.IndependentDevices, nil
 }
 
-// GetRoomList sends curl request to get list of rooms by home
-func (c *Client) GetRoomList(accessToken string, homeID int64) (*Client, error) {
-	url := fmt.Sprintf("%s%s%d", selectRoombyHomeURL, "?homeId=", homeID)
-	req, err := http.NewRequest("POST", url, nil)
-	if err != nil {
-		// handle err
-		log.Error(fmt.Errorf("Can't get room list, error: ", err))
+// SetpointResolution returns the setpoint step in C which the model of device accepts
+func (c *Client) SetpointResolution(device Device) float64 {
+	if resolution, ok := c.resolutions[device.SubDomainID]; ok && resolution > 0 {
+		return resolution
 	}
-	req.Header.Set("Accept", "*/*")
-	req.Header.Set("Access_token", accessToken)
+	if resolution, ok := DefaultSetpointResolutions[device.SubDomainID]; ok {
+		return resolution
+	}
+	return DefaultSetpointResolution
+}
 
-	resp, err := http.DefaultClient.Do(req)
-	processHTTPResponse(resp, err, c)
-	return c, nil
+// TempControl sets a new hold temperature on a device. newTemp is rounded to the nearest step the device model
+// accepts, see SetpointResolution. The rounded temperature which was sent to Mill is returned.
+func (c *Client) TempControl(ctx context.Context, accessToken string, device Device, newTemp float64) (float64, error) {
+	applied := RoundSetpoint(newTemp, c.SetpointResolution(device))
+	query := url.Values{}
+	query.Set("deviceId", strconv.FormatInt(device.DeviceID, 10))
+	query.Set("holdTemp", FormatTemp(applied))
+	query.Set("operation", "1")
+	query.Set("status", "1")
+	if err := c.post(ctx, EndpointDeviceControl, deviceControlPath, query, tokenHeader(accessToken), &Config{}); err != nil {
+		return 0, err
+	}
+	return applied, nil
 }
 
-// GetDeviceList sends curl request to get list of devices by room
-func (c *Client) GetDeviceList(accessToken string, roomID int64) (*Client, error) {
-	url := fmt.Sprintf("%s%s%d", selectDevicebyRoomURL, "?roomId=", roomID)
-	req, err := http.NewRequest("POST", url, nil)
-	if err != nil {
-		log.Error(fmt.Errorf("Can't get device list, error: ", err))
-		// handle err
-	}
-	req.Header.Set("Accept", "*/*")
-	req.Header.Set("Access_token", accessToken)
+// RoomTempControl sets the comfort, sleep and away temperatures of a room. Mill takes whole degrees.
+func (c *Client) RoomTempControl(ctx context.Context, accessToken string, roomID int64, comfortTemp, sleepTemp, awayTemp int) error {
+	query := url.Values{}
+	query.Set("roomId", strconv.FormatInt(roomID, 10))
+	query.Set("comfortTemp", strconv.Itoa(comfortTemp))
+	query.Set("sleepTemp", strconv.Itoa(sleepTemp))
+	query.Set("awayTemp", strconv.Itoa(awayTemp))
+	query.Set("homeType", "0")
+	return c.post(ctx, EndpointChangeRoomTemps, changeRoomModeTempInfoPath, query, tokenHeader(accessToken), &Config{})
+}
 
-	resp, err := http.DefaultClient.Do(req)
-	processHTTPResponse(resp, err, c)
-	return c, nil
+// SetHoliday puts a home in holiday mode from start to end. Heaters of the home heat to temp, in whole C, during the holiday.
+func (c *Client) SetHoliday(ctx context.Context, accessToken string, homeID int64, start, end time.Time, temp int) error {
+	if !end.After(start) {
+		return fmt.Errorf("holiday end %s is not after start %s", end.Format(time.RFC3339), start.Format(time.RFC3339))
+	}
+	query := url.Values{}
+	query.Set("homeId", strconv.FormatInt(homeID, 10))
+	query.Set("isHoliday", "1")
+	query.Set("holidayStartTime", strconv.FormatInt(start.Unix(), 10))
+	query.Set("holidayEndTime", strconv.FormatInt(end.Unix(), 10))
+	query.Set("holidayTemp", strconv.Itoa(temp))
+	return c.post(ctx, EndpointHolidayConfiguration, holidayConfigurationPath, query, tokenHeader(accessToken), &Config{})
 }
 
-func (c *Client) GetIndependentDevices(accessToken string, homeId int64) (*Client, error) {
-	url := fmt.Sprintf("%s%s%d", getIndependentDevicesURL, "?homeId=", homeId)
-	req, err := http.NewRequest("POST", url, nil)
-	if err != nil {
-		// handle err
-		log.Error(fmt.Errorf("Can't get independent device list, error: ", err))
-	}
-	req.Header.Set("Accept", "*/*")
-	req.Header.Set("Access_token", accessToken)
+// CancelHoliday ends holiday mode of a home, or cancels a planned holiday
+func (c *Client) CancelHoliday(ctx context.Context, accessToken string, homeID int64) error {
+	query := url.Values{}
+	query.Set("homeId", strconv.FormatInt(homeID, 10))
+	query.Set("isHoliday", "0")
+	return c.post(ctx, EndpointHolidayConfiguration, holidayConfigurationPath, query, tokenHeader(accessToken), &Config{})
+}
 
-	resp, err := http.DefaultClient.Do(req)
-	processHTTPResponse(resp, err, c)
-	return c, nil
+// SetHomeMode forces all rooms of a home into ModeComfort, ModeSleep or ModeAway for duration, which is rounded up
+// to whole minutes. ModeProgram ends a forced mode and ignores duration.
+func (c *Client) SetHomeMode(ctx context.Context, accessToken string, homeID int64, mode int, duration time.Duration) error {
+	minutes := 0
+	switch mode {
+	case ModeComfort, ModeSleep, ModeAway:
+		if duration <= 0 {
+			return fmt.Errorf("home mode %d needs a positive duration, got %s", mode, duration)
+		}
+		minutes = int((duration + time.Minute - 1) / time.Minute)
+	case ModeProgram:
+	default:
+		return fmt.Errorf("%w: home mode %d", ErrUnsupportedMode, mode)
+	}
+	query := url.Values{}
+	query.Set("homeId", strconv.FormatInt(homeID, 10))
+	query.Set("mode", strconv.Itoa(mode))
+	query.Set("modeHour", strconv.Itoa(minutes/60))
+	query.Set("modeMinute", strconv.Itoa(minutes%60))
+	return c.post(ctx, EndpointChangeHomeMode, changeHomeModePath, query, tokenHeader(accessToken), &Config{})
 }
 
-func (cf *Config) TempControl(accessToken string, deviceId string, newTemp string) bool {
-	url := fmt.Sprintf("%s%s%s%s%s%s", deviceControlURL, "?deviceId=", deviceId, "&holdTemp=", newTemp, "&operation=1&status=1")
-	req, err := http.NewRequest("POST", url, nil)
-	if err != nil {
-		// handle err
-		log.Error(fmt.Errorf("Can't controll device, error: ", err))
+// RoundSetpoint rounds temp to the nearest multiple of resolution
+func RoundSetpoint(temp, resolution float64) float64 {
+	if resolution <= 0 {
+		return temp
 	}
-	req.Header.Set("Accept", "*/*")
-	req.Header.Set("Access_token", accessToken)
+	rounded := math.Round(temp/resolution) * resolution
+	// drop floating point noise, e.g. 21.200000000000003 for a 0.1 step
+	return math.Round(rounded*100) / 100
+}
 
-	resp, err := http.DefaultClient.Do(req)
-	processHTTPResponse(resp, err, cf)
-	if err != nil {
-		log.Debug("Error in DeviceControl: ", err)
-	}
-	log.Debug("url: ", url)
-	if cf.ErrorCode == 0 {
-		return true
-	}
-	return false
+// FormatTemp formats a temperature without trailing zeros, e.g. "21" or "21.5"
+func FormatTemp(temp float64) string {
+	return strconv.FormatFloat(temp, 'f', -1, 64)
 }
 
-func (cf *Config) ModeControl(accessToken string, deviceId string, oldTemp int64, newMode string) bool {
+// ModeControl turns a device on ("heat") or off ("off"). Mill needs a hold temperature with every mode change,
+// holdTemp is limited to the range of the device and rounded like in TempControl. The hold temperature which was
+// sent to Mill is returned.
+func (c *Client) ModeControl(ctx context.Context, accessToken string, device Device, holdTemp float64, newMode string) (float64, error) {
 	var mode int
 	if newMode == "heat" {
 		mode = 1
 	} else if newMode == "off" {
 		mode = 0
 	} else {
-		log.Info("Unsupported mode: ", newMode)
-		return false
-	}
-	url := fmt.Sprintf("%s%s%s%s%d%s%d", deviceControlURL, "?deviceId=", deviceId, "&holdTemp=", oldTemp, "&operation=0&status=", mode)
-	req, err := http.NewRequest("POST", url, nil)
-	if err != nil {
-		// handle err
-		log.Error(fmt.Errorf("Can't controll device, error: ", err))
-	}
-	req.Header.Set("Accept", "*/*")
-	req.Header.Set("Access_token", accessToken)
-
-	resp, err := http.DefaultClient.Do(req)
-	processHTTPResponse(resp, err, cf)
-	if err != nil {
-		log.Debug("Error in DeviceControl: ", err)
-	}
-
-	if cf.ErrorCode == 0 {
-		return true
-	}
-	return false
+		return 0, fmt.Errorf("%w: %s", ErrUnsupportedMode, newMode)
+	}
+	minTemp, maxTemp := device.SetpointRange()
+	applied := RoundSetpoint(math.Max(minTemp, math.Min(holdTemp, maxTemp)), c.SetpointResolution(device))
+	query := url.Values{}
+	query.Set("deviceId", strconv.FormatInt(device.DeviceID, 10))
+	query.Set("holdTemp", FormatTemp(applied))
+	query.Set("operation", "0")
+	query.Set("status", strconv.Itoa(mode))
+	if err := c.post(ctx, EndpointDeviceControl, deviceControlPath, query, tokenHeader(accessToken), &Config{}); err != nil {
+		return 0, err
+	}
+	return applied, nil
 }
 
-func (cf *Config) GetAuthCode(oldMsg *fimpgo.Message) (string, string) {
-	cfs := model.Configs{}
-	val, err := oldMsg.Payload.GetStrMapValue()
-	if err != nil {
-		log.Error("Wrong msg format")
-		return "", ""
-	}
-	cfs.HubToken = val["token"]
-
+// GetAuthCode asks the Futurehome partner api for a Mill authorization code, using the hub token for authentication
+func (c *Client) GetAuthCode(ctx context.Context, hubToken string) (string, error) {
 	type Payload struct {
 		PartnerCode string `json:"partnerCode"`
 	}
@@ -354,80 +515,141 @@ func (cf *Config) GetAuthCode(oldMsg *fimpgo.Message) (string, string) {
 	}
 	payloadBytes, err := json.Marshal(data)
 	if err != nil {
-		// handle err
-		log.Debug("issue with payloadBytes")
+		return "", err
 	}
-	body := bytes.NewReader(payloadBytes)
 
-	var env string
-	hubInfo, err := utils.NewHubUtils().GetHubInfo()
-	if err == nil && hubInfo != nil {
-		env = hubInfo.Environment
-	} else {
-		// TODO: switch to prod
-		env = utils.EnvBeta
+	header := http.Header{}
+	header.Set("Authorization", "Bearer "+hubToken)
+	header.Set("Content-Type", "application/json")
+	header.Set("Cache-Control", "no-cache")
+
+	config := Config{}
+	if err = c.do(ctx, EndpointPartnerAuthCode, c.partnerURL+partnerAuthCodePath, payloadBytes, header, &config); err != nil {
+		return "", err
 	}
-	var url string
-	if env == utils.EnvBeta {
-		url = "https://partners-beta.futurehome.io/api/control/edge/proxy/custom/auth-code"
-	} else {
-		url = "https://partners.futurehome.io/api/control/edge/proxy/custom/auth-code"
+	return config.Data.AuthorizationCode, nil
+}
+
+func withTrailingSlash(u string) string {
+	if u != "" && u[len(u)-1] != '/' {
+		return u + "/"
 	}
+	return u
+}
+
+func tokenHeader(accessToken string) http.Header {
+	header := http.Header{}
+	header.Set("Access_token", accessToken)
+	return header
+}
 
-	req, err := http.NewRequest("POST", url, body)
+func (c *Client) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if c.timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, c.timeout)
+}
+
+func (c *Client) newRequest(ctx context.Context, reqURL string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", reqURL, body)
 	if err != nil {
-		// handle err
-		log.Debug(fmt.Errorf("Issue when making request to partner-api"))
+		return nil, err
 	}
-	req.Header.Set("Authorization", os.ExpandEnv(fmt.Sprintf("%s%s", "Bearer ", cfs.HubToken)))
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Postman-Token", "65cb80d3-cbd2-4c8d-954a-bb3253b306e5")
-	req.Header.Set("Cache-Control", "no-cache")
-	resp, err := http.DefaultClient.Do(req)
-	processHTTPResponse(resp, err, cf)
+	req.Header.Set("Accept", "*/*")
+	req.Header.Set("User-Agent", c.userAgent)
+	return req, nil
+}
 
-	authorizationCode := cf.Data.AuthorizationCode
-	return authorizationCode, cfs.HubToken
+// post sends a request to a Mill API endpoint and decodes the response into holder
+func (c *Client) post(ctx context.Context, endpoint string, path string, query url.Values, header http.Header, holder interface{}) error {
+	reqURL := c.baseURL + path
+	if len(query) > 0 {
+		reqURL += "?" + query.Encode()
+	}
+	return c.do(ctx, endpoint, reqURL, nil, header, holder)
 }
 
-// Unmarshall received data into holder struct
-func processHTTPResponse(resp *http.Response, err error, holder interface{}) error {
-	if err != nil {
-		log.Error(fmt.Errorf("API does not respond"))
-		return err
+// do sends a POST request and decodes the response into holder, retrying according to the retry policy
+func (c *Client) do(ctx context.Context, endpoint string, reqURL string, body []byte, header http.Header, holder interface{}) error {
+	err := c.doWithRetry(ctx, endpoint, reqURL, body, header, holder)
+	if c.observer != nil {
+		c.observer(endpoint, err)
 	}
-	defer resp.Body.Close()
-	// check http return code
-	if resp.StatusCode != 200 {
-		//bytes, _ := ioutil.ReadAll(resp.Body)
-		log.Error("Bad HTTP return code ", resp.StatusCode)
-		return fmt.Errorf("Bad HTTP return code %d", resp.StatusCode)
+	return err
+}
+
+func (c *Client) doWithRetry(ctx context.Context, endpoint string, reqURL string, body []byte, header http.Header, holder interface{}) error {
+	for attempt := 1; ; attempt++ {
+		err := c.doOnce(ctx, endpoint, reqURL, body, header, holder)
+		if err == nil {
+			return nil
+		}
+		delay, retry := c.retryPolicy.next(ctx, endpoint, attempt, err)
+		if !retry {
+			return err
+		}
+		log.Warnf("<mill> %s failed (attempt %d/%d), retrying in %s. Error: %v", endpoint, attempt, c.retryPolicy.MaxAttempts, delay, err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
 	}
+}
 
-	// Unmarshall response into given struct
-	if err = json.NewDecoder(resp.Body).Decode(holder); err != nil {
+func (c *Client) doOnce(ctx context.Context, endpoint string, reqURL string, body []byte, header http.Header, holder interface{}) error {
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+	var bodyReader io.Reader
+	if body != nil {
+		bodyReader = bytes.NewReader(body)
+	}
+	req, err := c.newRequest(ctx, reqURL, bodyReader)
+	if err != nil {
 		return err
 	}
-	return nil
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	log.Debugf("<mill> POST %s", endpoint)
+	resp, err := c.httpClient.Do(req)
+	return processHTTPResponse(endpoint, resp, err, holder)
+}
+
+// apiStatus is the status part of every Mill response envelope
+type apiStatus struct {
+	ErrorCode int    `json:"errorCode"`
+	Message   string `json:"message"`
 }
 
-func (c *Client) UpdateLists(accessToken string, hc []interface{}, rc []interface{}, dc []interface{}, idc []interface{}) (homelist []interface{}, roomlist []interface{}, devicelist []interface{}, independentdevicelist []interface{}) {
-	allDevices, allRooms, allHomes, allIndependentDevices, err := c.GetAllDevices(accessToken)
+// Unmarshall received data into holder struct. Returned errors are always of type *APIError.
+func processHTTPResponse(endpoint string, resp *http.Response, err error, holder interface{}) error {
 	if err != nil {
-		// handle err
-		log.Error(fmt.Errorf("Can't update lists, error: ", err))
+		return newTransportError(endpoint, err)
 	}
-	for home := range allHomes {
-		hc = append(hc, allHomes[home])
+	defer resp.Body.Close()
+	// check http return code
+	if resp.StatusCode != http.StatusOK {
+		apiErr := newStatusError(endpoint, resp.StatusCode)
+		apiErr.retryAfter = parseRetryAfter(resp.Header.Get("Retry-After"))
+		return apiErr
 	}
-	for room := range allRooms {
-		rc = append(rc, allRooms[room])
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return newTransportError(endpoint, err)
 	}
-	for device := range allDevices {
-		dc = append(dc, allDevices[device])
+
+	status := apiStatus{}
+	if err = json.Unmarshal(body, &status); err != nil {
+		return &APIError{Endpoint: endpoint, StatusCode: resp.StatusCode, kind: ErrBadResponse, err: err}
 	}
-	for device := range allIndependentDevices {
-		idc = append(idc, allIndependentDevices[device])
+	if status.ErrorCode != ErrorCodeOK {
+		return newCodeError(endpoint, status.ErrorCode, status.Message)
 	}
-	return hc, rc, dc, idc
+
+	// Unmarshall response into given struct
+	if err = json.Unmarshal(body, holder); err != nil {
+		return &APIError{Endpoint: endpoint, StatusCode: resp.StatusCode, kind: ErrBadResponse, err: err}
+	}
+	return nil
 }
@@ -0,0 +1,260 @@
+package mill_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	mill "github.com/thingsplex/mill/millapi"
+	"github.com/thingsplex/mill/millapi/milltest"
+)
+
+// fastRetries keeps the retry delays of the tests short
+var fastRetries = mill.RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: 200 * time.Millisecond}
+
+// newTestClient returns a client for a fake Mill cloud with one home, one room with a heater and one independent heater
+func newTestClient(t *testing.T, opts ...mill.Option) (*mill.Client, *milltest.Server, string) {
+	t.Helper()
+	server := milltest.NewServer()
+	t.Cleanup(server.Close)
+	server.AddHome(mill.Home{HomeID: 1, HomeName: "Home"})
+	server.AddRoom(1, mill.Room{RoomID: 10, RoomName: "Living room"})
+	server.AddDevice(10, mill.Device{DeviceID: 100, DeviceName: "Heater", SubDomainID: 5316})
+	server.AddIndependentDevice(1, mill.Device{DeviceID: 200, DeviceName: "Hallway", SubDomainID: 5316})
+
+	opts = append([]mill.Option{mill.WithBaseURL(server.URL), mill.WithPartnerURL(server.URL), mill.WithRetryPolicy(fastRetries)}, opts...)
+	client := mill.New(opts...)
+	accessToken, _, _, _, err := client.GetAccessToken(context.Background(), milltest.DefaultAuthCode, milltest.DefaultPassword, milltest.DefaultUsername)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, server, accessToken
+}
+
+func TestReadsAreRetried(t *testing.T) {
+	client, server, accessToken := newTestClient(t)
+	server.FailNext(mill.EndpointSelectHomeList, milltest.Failure{StatusCode: http.StatusInternalServerError}, milltest.Failure{ErrorCode: mill.ErrorCodeRateLimited})
+
+	homes, err := client.GetHomeList(context.Background(), accessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(homes) != 1 {
+		t.Errorf("got %d homes, want 1", len(homes))
+	}
+	if calls := server.Calls(mill.EndpointSelectHomeList); calls != 3 {
+		t.Errorf("%d requests, want 3", calls)
+	}
+}
+
+func TestReadsGiveUpAfterMaxAttempts(t *testing.T) {
+	client, server, accessToken := newTestClient(t)
+	failure := milltest.Failure{StatusCode: http.StatusBadGateway}
+	server.FailNext(mill.EndpointSelectHomeList, failure, failure, failure)
+
+	_, err := client.GetHomeList(context.Background(), accessToken)
+	if !errors.Is(err, mill.ErrUnavailable) {
+		t.Errorf("got %v, want ErrUnavailable", err)
+	}
+	if calls := server.Calls(mill.EndpointSelectHomeList); calls != fastRetries.MaxAttempts {
+		t.Errorf("%d requests, want %d", calls, fastRetries.MaxAttempts)
+	}
+}
+
+func TestRetryAfterIsHonored(t *testing.T) {
+	client, server, accessToken := newTestClient(t)
+	server.FailNext(mill.EndpointSelectHomeList, milltest.Failure{StatusCode: http.StatusTooManyRequests, RetryAfter: "1"})
+
+	start := time.Now()
+	if _, err := client.GetHomeList(context.Background(), accessToken); err != nil {
+		t.Fatal(err)
+	}
+	// Retry-After asks for 1s, which is capped at MaxDelay, but still far above BaseDelay
+	if elapsed := time.Since(start); elapsed < fastRetries.MaxDelay {
+		t.Errorf("retried after %s, want at least %s", elapsed, fastRetries.MaxDelay)
+	}
+}
+
+func TestControlRetriedOnlyWhenNotProcessed(t *testing.T) {
+	client, server, accessToken := newTestClient(t)
+	device, _ := server.Device(100)
+
+	// Mill may have applied the setpoint before failing, so a 500 is not repeated
+	server.FailNext(mill.EndpointDeviceControl, milltest.Failure{StatusCode: http.StatusInternalServerError})
+	if _, err := client.TempControl(context.Background(), accessToken, device, 21); !errors.Is(err, mill.ErrUnavailable) {
+		t.Errorf("got %v, want ErrUnavailable", err)
+	}
+	if calls := server.Calls(mill.EndpointDeviceControl); calls != 1 {
+		t.Errorf("%d requests after a 500, want 1", calls)
+	}
+
+	// 503 and rate limits mean the request was not processed
+	server.FailNext(mill.EndpointDeviceControl, milltest.Failure{StatusCode: http.StatusServiceUnavailable}, milltest.Failure{StatusCode: http.StatusTooManyRequests})
+	if _, err := client.TempControl(context.Background(), accessToken, device, 21); err != nil {
+		t.Fatal(err)
+	}
+	if calls := server.Calls(mill.EndpointDeviceControl); calls != 4 {
+		t.Errorf("%d requests, want 4", calls)
+	}
+	if controls := server.Controls(); len(controls) != 1 || controls[0].HoldTemp != "21" {
+		t.Errorf("got controls %+v, want a single control to 21", controls)
+	}
+}
+
+func TestErrorCodesAreClassified(t *testing.T) {
+	client, server, accessToken := newTestClient(t)
+	device, _ := server.Device(100)
+	tests := []struct {
+		failure milltest.Failure
+		want    error
+	}{
+		{milltest.Failure{ErrorCode: mill.ErrorCodeDeviceOffline, Message: "offline"}, mill.ErrDeviceOffline},
+		{milltest.Failure{ErrorCode: mill.ErrorCodeTokenExpired}, mill.ErrTokenExpired},
+		{milltest.Failure{ErrorCode: 9999}, mill.ErrBadResponse},
+		{milltest.Failure{StatusCode: http.StatusUnauthorized}, mill.ErrTokenExpired},
+	}
+	for _, test := range tests {
+		server.FailNext(mill.EndpointDeviceControl, test.failure)
+		_, err := client.TempControl(context.Background(), accessToken, device, 21)
+		if !errors.Is(err, test.want) {
+			t.Errorf("failure %+v: got %v, want %v", test.failure, err, test.want)
+		}
+	}
+}
+
+func TestExpiredTokens(t *testing.T) {
+	client, server, accessToken := newTestClient(t)
+	ctx := context.Background()
+
+	server.ExpireAccessToken()
+	if _, err := client.GetHomeList(ctx, accessToken); !errors.Is(err, mill.ErrTokenExpired) {
+		t.Fatalf("got %v, want ErrTokenExpired", err)
+	}
+	_, refreshToken := server.Tokens()
+	accessToken, refreshToken, _, _, err := client.RefreshToken(ctx, refreshToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.GetHomeList(ctx, accessToken); err != nil {
+		t.Errorf("refreshed access token rejected: %v", err)
+	}
+
+	server.ExpireRefreshToken()
+	if _, _, _, _, err := client.RefreshToken(ctx, refreshToken); !errors.Is(err, mill.ErrTokenExpired) {
+		t.Errorf("got %v, want ErrTokenExpired", err)
+	}
+	if _, _, _, _, err := client.GetAccessToken(ctx, milltest.DefaultAuthCode, "wrong", milltest.DefaultUsername); !errors.Is(err, mill.ErrInvalidCredentials) {
+		t.Errorf("got %v, want ErrInvalidCredentials", err)
+	}
+}
+
+func TestSlowResponsesTimeOut(t *testing.T) {
+	var observed error
+	observer := mill.WithRequestObserver(func(endpoint string, err error) {
+		observed = err
+	})
+	client, server, accessToken := newTestClient(t, mill.WithTimeout(50*time.Millisecond), mill.WithRetryPolicy(mill.RetryPolicy{MaxAttempts: 1}), observer)
+
+	server.SetDelay(200 * time.Millisecond)
+	_, err := client.GetHomeList(context.Background(), accessToken)
+	if !errors.Is(err, mill.ErrUnavailable) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want ErrUnavailable wrapping DeadlineExceeded", err)
+	}
+	if observed != err {
+		t.Errorf("observer got %v, want %v", observed, err)
+	}
+}
+
+func TestGetAllDevicesKeepsPartialResults(t *testing.T) {
+	client, server, accessToken := newTestClient(t)
+	ctx := context.Background()
+
+	server.FailNext(mill.EndpointGetIndependentDevices, milltest.Failure{StatusCode: http.StatusBadRequest})
+	inv, err := client.GetAllDevices(ctx, accessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !errors.Is(inv.Err(), mill.ErrBadResponse) || inv.Homes[0].IndependentErr == nil {
+		t.Errorf("got inventory error %v, want the independent device failure", inv.Err())
+	}
+	if devices := inv.AllDevices(); len(devices) != 1 || devices[0].DeviceID != 100 {
+		t.Errorf("got devices %+v, want the room heater", devices)
+	}
+
+	server.FailNext(mill.EndpointSelectDevicebyRoom, milltest.Failure{StatusCode: http.StatusBadRequest})
+	inv, err = client.GetAllDevices(ctx, accessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(inv.Homes[0].Rooms) != 1 || inv.Homes[0].Rooms[0].Err == nil {
+		t.Errorf("room device failure not recorded: %+v", inv.Homes[0].Rooms)
+	}
+	if devices := inv.AllDevices(); len(devices) != 1 || devices[0].DeviceID != 200 {
+		t.Errorf("got devices %+v, want the independent heater", devices)
+	}
+
+	server.FailNext(mill.EndpointSelectHomeList, milltest.Failure{StatusCode: http.StatusBadRequest})
+	if _, err := client.GetAllDevices(ctx, accessToken); err == nil {
+		t.Error("home list failure not returned")
+	}
+}
+
+func TestTempControlUsesModelResolution(t *testing.T) {
+	client, server, accessToken := newTestClient(t, mill.WithSetpointResolutions(map[int]float64{6933: 1}))
+	tests := []struct {
+		subDomainID int
+		temp        float64
+		want        float64
+	}{
+		{5332, 21.3, 21.5}, // half degrees by default
+		{5316, 21.3, 21},   // not listed, whole degrees
+		{6933, 21.3, 21},   // configured resolution overrides the default
+	}
+	for _, test := range tests {
+		device := mill.Device{DeviceID: 100, SubDomainID: test.subDomainID}
+		applied, err := client.TempControl(context.Background(), accessToken, device, test.temp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if applied != test.want {
+			t.Errorf("model %d: %v applied as %v, want %v", test.subDomainID, test.temp, applied, test.want)
+		}
+		controls := server.Controls()
+		if holdTemp := controls[len(controls)-1].HoldTemp; holdTemp != mill.FormatTemp(test.want) {
+			t.Errorf("model %d: sent %s, want %s", test.subDomainID, holdTemp, mill.FormatTemp(test.want))
+		}
+	}
+}
+
+func TestModeControlLimitsHoldTemp(t *testing.T) {
+	client, server, accessToken := newTestClient(t)
+	tests := []struct {
+		device   mill.Device
+		holdTemp float64
+		want     float64
+	}{
+		{mill.Device{DeviceID: 100, SubDomainID: 5332}, 21.3, 21.5},
+		{mill.Device{DeviceID: 100, SubDomainID: 5316}, 21.3, 21},
+		{mill.Device{DeviceID: 100, MaxTemperature: 25}, 30, 25},
+		{mill.Device{DeviceID: 100}, 0, mill.MinSetpoint},
+	}
+	for _, test := range tests {
+		applied, err := client.ModeControl(context.Background(), accessToken, test.device, test.holdTemp, "heat")
+		if err != nil {
+			t.Fatal(err)
+		}
+		controls := server.Controls()
+		sent := controls[len(controls)-1]
+		if applied != test.want || sent.HoldTemp != mill.FormatTemp(test.want) {
+			t.Errorf("hold temperature %v of %+v: applied %v, sent %s, want %v", test.holdTemp, test.device, applied, sent.HoldTemp, test.want)
+		}
+		if sent.Operation != 0 || sent.Status != 1 {
+			t.Errorf("got operation %d, status %d, want a mode change to heat", sent.Operation, sent.Status)
+		}
+	}
+	if _, err := client.ModeControl(context.Background(), accessToken, mill.Device{DeviceID: 100}, 21, "cool"); !errors.Is(err, mill.ErrUnsupportedMode) {
+		t.Errorf("got %v, want ErrUnsupportedMode", err)
+	}
+}
@@ -0,0 +1,165 @@
+package mill
+
+import (
+	"context"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultCrawlWorkers is how many requests GetAllDevices runs in parallel unless set with WithCrawlWorkers
+const DefaultCrawlWorkers = 4
+
+// Inventory is a snapshot of all homes, rooms and devices of an account
+type Inventory struct {
+	Homes []HomeInventory
+}
+
+// HomeInventory holds the rooms and devices of one home. If any request for the home failed,
+// the lists are incomplete and Err returns the first failure.
+type HomeInventory struct {
+	Home               Home
+	Rooms              []RoomInventory
+	IndependentDevices []Device
+	RoomsErr           error // the room list could not be fetched, Rooms is empty
+	IndependentErr     error // the independent device list could not be fetched, IndependentDevices is empty
+}
+
+// RoomInventory holds the devices of one room
+type RoomInventory struct {
+	Room    Room
+	Devices []Device
+	Err     error // the device list could not be fetched, Devices is empty
+}
+
+// Err returns the first failure while fetching the home, or nil if its lists are complete
+func (h *HomeInventory) Err() error {
+	if h.RoomsErr != nil {
+		return h.RoomsErr
+	}
+	for i := range h.Rooms {
+		if h.Rooms[i].Err != nil {
+			return h.Rooms[i].Err
+		}
+	}
+	return h.IndependentErr
+}
+
+// Err returns the first failure of any home, or nil if the snapshot is complete
+func (inv *Inventory) Err() error {
+	for i := range inv.Homes {
+		if err := inv.Homes[i].Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AllHomes returns the homes in the order Mill returned them
+func (inv *Inventory) AllHomes() []Home {
+	homes := make([]Home, 0, len(inv.Homes))
+	for i := range inv.Homes {
+		homes = append(homes, inv.Homes[i].Home)
+	}
+	return homes
+}
+
+// AllRooms returns the rooms of all homes
+func (inv *Inventory) AllRooms() []Room {
+	var rooms []Room
+	for i := range inv.Homes {
+		for j := range inv.Homes[i].Rooms {
+			rooms = append(rooms, inv.Homes[i].Rooms[j].Room)
+		}
+	}
+	return rooms
+}
+
+// AllDevices returns the devices of all homes, including independent devices
+func (inv *Inventory) AllDevices() []Device {
+	var devices []Device
+	for i := range inv.Homes {
+		for j := range inv.Homes[i].Rooms {
+			devices = append(devices, inv.Homes[i].Rooms[j].Devices...)
+		}
+		devices = append(devices, inv.Homes[i].IndependentDevices...)
+	}
+	return devices
+}
+
+// GetAllDevices fetches all homes, and then the rooms, room devices and independent devices of every home in
+// parallel, with at most crawlWorkers requests in flight. An error is returned only if the home list can't be
+// fetched. Failures for single homes are recorded in the inventory, see Inventory.Err.
+func (c *Client) GetAllDevices(ctx context.Context, accessToken string) (*Inventory, error) {
+	homes, err := c.GetHomeList(ctx, accessToken)
+	if err != nil {
+		return nil, err
+	}
+	inv := &Inventory{Homes: make([]HomeInventory, len(homes))}
+	cr := newCrawler(c.crawlWorkers)
+	for i := range homes {
+		home := &inv.Homes[i]
+		home.Home = homes[i]
+		cr.run(func() {
+			rooms, err := c.GetRoomList(ctx, accessToken, home.Home.HomeID)
+			if err != nil {
+				log.Error("<mill> Can't get room list, error: ", err)
+				home.RoomsErr = err
+				return
+			}
+			home.Rooms = make([]RoomInventory, len(rooms))
+			for j := range rooms {
+				room := &home.Rooms[j]
+				room.Room = rooms[j]
+				cr.run(func() {
+					devices, err := c.GetDeviceList(ctx, accessToken, room.Room.RoomID)
+					if err != nil {
+						log.Error("<mill> Can't get device list, error: ", err)
+						room.Err = err
+						return
+					}
+					room.Devices = devices
+				})
+			}
+		})
+		cr.run(func() {
+			devices, err := c.GetIndependentDevices(ctx, accessToken, home.Home.HomeID)
+			if err != nil {
+				log.Error("<mill> Can't get independent device list, error: ", err)
+				home.IndependentErr = err
+				return
+			}
+			home.IndependentDevices = devices
+		})
+	}
+	cr.wait()
+	return inv, nil
+}
+
+// crawler runs jobs with bounded concurrency. Jobs may start more jobs, so a slot is taken
+// inside the job's goroutine instead of when the job is started.
+type crawler struct {
+	wg    sync.WaitGroup
+	slots chan struct{}
+}
+
+func newCrawler(workers int) *crawler {
+	if workers < 1 {
+		workers = 1
+	}
+	return &crawler{slots: make(chan struct{}, workers)}
+}
+
+func (cr *crawler) run(job func()) {
+	cr.wg.Add(1)
+	go func() {
+		defer cr.wg.Done()
+		cr.slots <- struct{}{}
+		defer func() { <-cr.slots }()
+		job()
+	}()
+}
+
+func (cr *crawler) wait() {
+	cr.wg.Wait()
+}
@@ -0,0 +1,113 @@
+package mill
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Sentinel errors callers can match with errors.Is against any error returned by this package.
+var (
+	ErrTokenExpired       = errors.New("mill: access token expired or invalid")
+	ErrInvalidCredentials = errors.New("mill: invalid credentials")
+	ErrDeviceOffline      = errors.New("mill: device offline")
+	ErrRateLimited        = errors.New("mill: rate limited")
+	ErrUnavailable        = errors.New("mill: api unavailable")
+	ErrBadResponse        = errors.New("mill: unexpected response")
+	ErrUnsupportedMode    = errors.New("mill: unsupported mode")
+)
+
+// Mill errorCode values with a known meaning. Anything else is reported as ErrBadResponse.
+const (
+	ErrorCodeOK                 = 0
+	ErrorCodeTokenExpired       = 3502
+	ErrorCodeRateLimited        = 3504
+	ErrorCodeDeviceOffline      = 3510
+	ErrorCodeInvalidCredentials = 3515
+)
+
+var errorCodes = map[int]error{
+	ErrorCodeTokenExpired:       ErrTokenExpired,
+	ErrorCodeRateLimited:        ErrRateLimited,
+	ErrorCodeDeviceOffline:      ErrDeviceOffline,
+	ErrorCodeInvalidCredentials: ErrInvalidCredentials,
+}
+
+// APIError describes a failed call to a Mill endpoint.
+// StatusCode is 0 when no HTTP response was received.
+type APIError struct {
+	Endpoint   string
+	StatusCode int
+	ErrorCode  int
+	Message    string
+
+	kind       error         // one of the sentinel errors above
+	err        error         // underlying transport or decode error, if any
+	retryAfter time.Duration // from the Retry-After header, if any
+}
+
+func (e *APIError) Error() string {
+	msg := fmt.Sprintf("%s: %s", e.Endpoint, e.kind)
+	if e.StatusCode != 0 && e.StatusCode != http.StatusOK {
+		msg += fmt.Sprintf(" (http %d)", e.StatusCode)
+	}
+	if e.ErrorCode != ErrorCodeOK {
+		msg += fmt.Sprintf(" (errorCode %d)", e.ErrorCode)
+	}
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	if e.err != nil {
+		msg += ": " + e.err.Error()
+	}
+	return msg
+}
+
+// Is reports whether target is the sentinel error this APIError was classified as.
+func (e *APIError) Is(target error) bool {
+	return e.kind == target
+}
+
+// Unwrap returns the underlying transport or decode error.
+func (e *APIError) Unwrap() error {
+	return e.err
+}
+
+// newTransportError wraps an error returned before any HTTP response was received.
+// The request url is dropped, since query parameters can carry credentials and tokens.
+func newTransportError(endpoint string, err error) *APIError {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		err = urlErr.Err
+	}
+	return &APIError{Endpoint: endpoint, kind: ErrUnavailable, err: err}
+}
+
+// newStatusError classifies a non-200 HTTP response.
+func newStatusError(endpoint string, statusCode int) *APIError {
+	apiErr := &APIError{Endpoint: endpoint, StatusCode: statusCode, kind: ErrBadResponse}
+	switch {
+	case statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden:
+		if endpoint == EndpointApplyAccessToken {
+			apiErr.kind = ErrInvalidCredentials
+		} else {
+			apiErr.kind = ErrTokenExpired
+		}
+	case statusCode == http.StatusTooManyRequests:
+		apiErr.kind = ErrRateLimited
+	case statusCode >= http.StatusInternalServerError:
+		apiErr.kind = ErrUnavailable
+	}
+	return apiErr
+}
+
+// newCodeError classifies a 200 response whose body carries a non-zero Mill errorCode.
+func newCodeError(endpoint string, errorCode int, message string) *APIError {
+	apiErr := &APIError{Endpoint: endpoint, StatusCode: http.StatusOK, ErrorCode: errorCode, Message: message, kind: ErrBadResponse}
+	if kind, ok := errorCodes[errorCode]; ok {
+		apiErr.kind = kind
+	}
+	return apiErr
+}
@@ -0,0 +1,525 @@
+// Package milltest provides an in-memory fake of the Mill cloud api for tests and local development.
+//
+//	srv := milltest.NewServer()
+//	defer srv.Close()
+//	srv.AddHome(mill.Home{HomeID: 1, HomeName: "Home"})
+//	srv.AddRoom(1, mill.Room{RoomID: 10, RoomName: "Living room"})
+//	srv.AddDevice(10, mill.Device{DeviceID: 100, DeviceName: "Heater"})
+//	client := mill.New(mill.WithBaseURL(srv.URL), mill.WithPartnerURL(srv.URL))
+package milltest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"time"
+
+	mill "github.com/thingsplex/mill/millapi"
+)
+
+// Credentials accepted by a new server
+const (
+	DefaultUsername = "user@example.com"
+	DefaultPassword = "password"
+	DefaultAuthCode = "auth-code"
+	DefaultHubToken = "hub-token"
+)
+
+// Token lifetimes handed out by the server, matching the real Mill api
+const (
+	AccessTokenTTL  = 2 * time.Hour
+	RefreshTokenTTL = 30 * 24 * time.Hour
+)
+
+// Failure is a scripted response for one request to an endpoint
+type Failure struct {
+	Delay      time.Duration // wait before answering, also applied when no other failure field is set
+	StatusCode int           // http status code, zero keeps 200
+	ErrorCode  int           // Mill errorCode in a 200 response
+	Message    string        // Mill message in a 200 response
+	RetryAfter string        // value of the Retry-After header
+}
+
+// ControlRequest is a deviceControlForOpenApi request received by the server
+type ControlRequest struct {
+	DeviceID  int64
+	HoldTemp  string
+	Operation int
+	Status    int
+}
+
+// Server is a fake Mill cloud backed by httptest.Server. All methods are safe for concurrent use.
+type Server struct {
+	*httptest.Server
+
+	mu                 sync.Mutex
+	username           string
+	password           string
+	authCode           string
+	hubToken           string
+	accessToken        string
+	refreshToken       string
+	accessExpireTime   time.Time
+	refreshExpireTime  time.Time
+	tokenSeq           int
+	homes              []mill.Home
+	rooms              map[int64][]mill.Room   // by home id
+	devices            map[int64][]mill.Device // by room id
+	independentDevices map[int64][]mill.Device // by home id
+	offline            map[int64]bool          // by device id
+	failures           map[string][]Failure    // by endpoint
+	delay              time.Duration
+	calls              map[string]int // by endpoint
+	controls           []ControlRequest
+}
+
+// NewServer starts a fake Mill cloud with the default credentials and no homes
+func NewServer() *Server {
+	s := NewUnstartedServer()
+	s.Start()
+	return s
+}
+
+// NewUnstartedServer returns a fake Mill cloud which is not started yet.
+// Replace Listener before calling Start to serve on a fixed address during local development.
+func NewUnstartedServer() *Server {
+	s := &Server{
+		username:           DefaultUsername,
+		password:           DefaultPassword,
+		authCode:           DefaultAuthCode,
+		hubToken:           DefaultHubToken,
+		rooms:              make(map[int64][]mill.Room),
+		devices:            make(map[int64][]mill.Device),
+		independentDevices: make(map[int64][]mill.Device),
+		offline:            make(map[int64]bool),
+		failures:           make(map[string][]Failure),
+		calls:              make(map[string]int),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/share/applyAccessToken", s.handle(mill.EndpointApplyAccessToken, s.applyAccessToken))
+	mux.HandleFunc("/share/refreshtoken", s.handle(mill.EndpointRefreshToken, s.refreshTokens))
+	mux.HandleFunc("/uds/selectHomeList", s.handle(mill.EndpointSelectHomeList, s.authorized(s.selectHomeList)))
+	mux.HandleFunc("/uds/selectRoombyHome", s.handle(mill.EndpointSelectRoombyHome, s.authorized(s.selectRoombyHome)))
+	mux.HandleFunc("/uds/selectDevicebyRoom", s.handle(mill.EndpointSelectDevicebyRoom, s.authorized(s.selectDevicebyRoom)))
+	mux.HandleFunc("/uds/getIndependentDevices", s.handle(mill.EndpointGetIndependentDevices, s.authorized(s.getIndependentDevices)))
+	mux.HandleFunc("/uds/deviceControlForOpenApi", s.handle(mill.EndpointDeviceControl, s.authorized(s.deviceControl)))
+	mux.HandleFunc("/uds/changeRoomModeTempInfo", s.handle(mill.EndpointChangeRoomTemps, s.authorized(s.changeRoomTemps)))
+	mux.HandleFunc("/uds/holidayChomeConfiguration", s.handle(mill.EndpointHolidayConfiguration, s.authorized(s.holidayConfiguration)))
+	mux.HandleFunc("/uds/changeHomeMode", s.handle(mill.EndpointChangeHomeMode, s.authorized(s.changeHomeMode)))
+	mux.HandleFunc("/api/control/edge/proxy/custom/auth-code", s.handle(mill.EndpointPartnerAuthCode, s.partnerAuthCode))
+	s.Server = httptest.NewUnstartedServer(mux)
+	return s
+}
+
+// SetCredentials changes the username, password and authorization code the server accepts
+func (s *Server) SetCredentials(username, password, authCode string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.username, s.password, s.authCode = username, password, authCode
+}
+
+// AddHome adds a home to the account
+func (s *Server) AddHome(home mill.Home) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.homes = append(s.homes, home)
+}
+
+// AddRoom adds a room to a home
+func (s *Server) AddRoom(homeID int64, room mill.Room) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rooms[homeID] = append(s.rooms[homeID], room)
+}
+
+// AddDevice adds a device to a room
+func (s *Server) AddDevice(roomID int64, device mill.Device) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.devices[roomID] = append(s.devices[roomID], device)
+}
+
+// AddIndependentDevice adds a device which is not assigned to any room of the home
+func (s *Server) AddIndependentDevice(homeID int64, device mill.Device) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.independentDevices[homeID] = append(s.independentDevices[homeID], device)
+}
+
+// Device returns the current server side state of a device
+func (s *Server) Device(deviceID int64) (mill.Device, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if device := s.findDevice(deviceID); device != nil {
+		return *device, true
+	}
+	return mill.Device{}, false
+}
+
+// Room returns the current server side state of a room
+func (s *Server) Room(roomID int64) (mill.Room, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if room := s.findRoom(roomID); room != nil {
+		return *room, true
+	}
+	return mill.Room{}, false
+}
+
+// Home returns the current server side state of a home
+func (s *Server) Home(homeID int64) (mill.Home, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if home := s.findHome(homeID); home != nil {
+		return *home, true
+	}
+	return mill.Home{}, false
+}
+
+// SetOffline makes control requests to the device fail with ErrorCodeDeviceOffline
+func (s *Server) SetOffline(deviceID int64, offline bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.offline[deviceID] = offline
+}
+
+// ExpireAccessToken makes the current access token invalid, so only a token refresh brings the client back
+func (s *Server) ExpireAccessToken() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.accessExpireTime = time.Now().Add(-time.Second)
+}
+
+// ExpireRefreshToken makes the current refresh token invalid, so only a new login brings the client back
+func (s *Server) ExpireRefreshToken() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.accessExpireTime = time.Now().Add(-time.Second)
+	s.refreshExpireTime = time.Now().Add(-time.Second)
+}
+
+// Tokens returns the currently valid access and refresh token
+func (s *Server) Tokens() (accessToken, refreshToken string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.accessToken, s.refreshToken
+}
+
+// FailNext queues failures for the next requests to an endpoint, one failure per request
+func (s *Server) FailNext(endpoint string, failures ...Failure) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures[endpoint] = append(s.failures[endpoint], failures...)
+}
+
+// SetDelay slows down every response
+func (s *Server) SetDelay(delay time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.delay = delay
+}
+
+// Calls returns the number of requests received by an endpoint, including failed ones
+func (s *Server) Calls(endpoint string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.calls[endpoint]
+}
+
+// Controls returns all control requests received so far
+func (s *Server) Controls() []ControlRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]ControlRequest(nil), s.controls...)
+}
+
+// handle counts the request and applies scripted failures before calling the endpoint handler
+func (s *Server) handle(endpoint string, handler func(r *http.Request) (interface{}, int, string)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.calls[endpoint]++
+		delay := s.delay
+		var failure *Failure
+		if queue := s.failures[endpoint]; len(queue) > 0 {
+			failure = &queue[0]
+			s.failures[endpoint] = queue[1:]
+			delay += failure.Delay
+		}
+		s.mu.Unlock()
+
+		if delay > 0 {
+			select {
+			case <-time.After(delay):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if failure != nil {
+			if failure.RetryAfter != "" {
+				w.Header().Set("Retry-After", failure.RetryAfter)
+			}
+			if failure.StatusCode != 0 && failure.StatusCode != http.StatusOK {
+				w.WriteHeader(failure.StatusCode)
+				return
+			}
+			if failure.ErrorCode != mill.ErrorCodeOK {
+				writeResponse(w, nil, failure.ErrorCode, failure.Message)
+				return
+			}
+		}
+		data, errorCode, message := handler(r)
+		writeResponse(w, data, errorCode, message)
+	}
+}
+
+// authorized rejects requests without a valid access token
+func (s *Server) authorized(handler func(r *http.Request) (interface{}, int, string)) func(r *http.Request) (interface{}, int, string) {
+	return func(r *http.Request) (interface{}, int, string) {
+		s.mu.Lock()
+		valid := s.accessToken != "" && r.Header.Get("Access_token") == s.accessToken && time.Now().Before(s.accessExpireTime)
+		s.mu.Unlock()
+		if !valid {
+			return nil, mill.ErrorCodeTokenExpired, "access token expired"
+		}
+		return handler(r)
+	}
+}
+
+func (s *Server) applyAccessToken(r *http.Request) (interface{}, int, string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	query := r.URL.Query()
+	if r.Header.Get("Authorization_code") != s.authCode || query.Get("username") != s.username || query.Get("password") != s.password {
+		return nil, mill.ErrorCodeInvalidCredentials, "wrong username or password"
+	}
+	return s.issueTokens(), mill.ErrorCodeOK, ""
+}
+
+func (s *Server) refreshTokens(r *http.Request) (interface{}, int, string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.refreshToken == "" || r.URL.Query().Get("refreshtoken") != s.refreshToken || !time.Now().Before(s.refreshExpireTime) {
+		return nil, mill.ErrorCodeTokenExpired, "refresh token expired"
+	}
+	return s.issueTokens(), mill.ErrorCodeOK, ""
+}
+
+// issueTokens must be called with mu held
+func (s *Server) issueTokens() interface{} {
+	s.tokenSeq++
+	now := time.Now()
+	s.accessToken = fmt.Sprintf("access-%d", s.tokenSeq)
+	s.refreshToken = fmt.Sprintf("refresh-%d", s.tokenSeq)
+	s.accessExpireTime = now.Add(AccessTokenTTL)
+	s.refreshExpireTime = now.Add(RefreshTokenTTL)
+	return map[string]interface{}{
+		"access_token":       s.accessToken,
+		"refresh_token":      s.refreshToken,
+		"expireTime":         toMillis(s.accessExpireTime),
+		"refresh_expireTime": toMillis(s.refreshExpireTime),
+	}
+}
+
+func (s *Server) selectHomeList(r *http.Request) (interface{}, int, string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return map[string]interface{}{"homeList": append([]mill.Home{}, s.homes...)}, mill.ErrorCodeOK, ""
+}
+
+func (s *Server) selectRoombyHome(r *http.Request) (interface{}, int, string) {
+	homeID, err := strconv.ParseInt(r.URL.Query().Get("homeId"), 10, 64)
+	if err != nil {
+		return nil, 1, "invalid homeId"
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return map[string]interface{}{"roomList": append([]mill.Room{}, s.rooms[homeID]...)}, mill.ErrorCodeOK, ""
+}
+
+func (s *Server) selectDevicebyRoom(r *http.Request) (interface{}, int, string) {
+	roomID, err := strconv.ParseInt(r.URL.Query().Get("roomId"), 10, 64)
+	if err != nil {
+		return nil, 1, "invalid roomId"
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return map[string]interface{}{"deviceList": append([]mill.Device{}, s.devices[roomID]...)}, mill.ErrorCodeOK, ""
+}
+
+func (s *Server) getIndependentDevices(r *http.Request) (interface{}, int, string) {
+	homeID, err := strconv.ParseInt(r.URL.Query().Get("homeId"), 10, 64)
+	if err != nil {
+		return nil, 1, "invalid homeId"
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return map[string]interface{}{"deviceInfoList": append([]mill.Device{}, s.independentDevices[homeID]...)}, mill.ErrorCodeOK, ""
+}
+
+func (s *Server) deviceControl(r *http.Request) (interface{}, int, string) {
+	query := r.URL.Query()
+	deviceID, err := strconv.ParseInt(query.Get("deviceId"), 10, 64)
+	if err != nil {
+		return nil, 1, "invalid deviceId"
+	}
+	operation, _ := strconv.Atoi(query.Get("operation"))
+	status, _ := strconv.Atoi(query.Get("status"))
+	control := ControlRequest{DeviceID: deviceID, HoldTemp: query.Get("holdTemp"), Operation: operation, Status: status}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.controls = append(s.controls, control)
+	device := s.findDevice(deviceID)
+	if device == nil {
+		return nil, 1, "device not found"
+	}
+	if s.offline[deviceID] {
+		return nil, mill.ErrorCodeDeviceOffline, "device offline"
+	}
+	if operation == 1 {
+		if holdTemp, err := strconv.ParseFloat(control.HoldTemp, 64); err == nil {
+			device.SetpointTemp = holdTemp
+		}
+	}
+	return nil, mill.ErrorCodeOK, ""
+}
+
+func (s *Server) changeRoomTemps(r *http.Request) (interface{}, int, string) {
+	query := r.URL.Query()
+	roomID, err := strconv.ParseInt(query.Get("roomId"), 10, 64)
+	if err != nil {
+		return nil, 1, "invalid roomId"
+	}
+	comfortTemp, err1 := strconv.Atoi(query.Get("comfortTemp"))
+	sleepTemp, err2 := strconv.Atoi(query.Get("sleepTemp"))
+	awayTemp, err3 := strconv.Atoi(query.Get("awayTemp"))
+	if err1 != nil || err2 != nil || err3 != nil {
+		return nil, 1, "invalid temperature"
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	room := s.findRoom(roomID)
+	if room == nil {
+		return nil, 1, "room not found"
+	}
+	room.ComfortTemp, room.SleepTemp, room.AwayTemp = comfortTemp, sleepTemp, awayTemp
+	return nil, mill.ErrorCodeOK, ""
+}
+
+func (s *Server) holidayConfiguration(r *http.Request) (interface{}, int, string) {
+	query := r.URL.Query()
+	homeID, err := strconv.ParseInt(query.Get("homeId"), 10, 64)
+	if err != nil {
+		return nil, 1, "invalid homeId"
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	home := s.findHome(homeID)
+	if home == nil {
+		return nil, 1, "home not found"
+	}
+	if query.Get("isHoliday") != "1" {
+		home.IsHoliday, home.HolidayStartTime, home.HolidayEndTime, home.HolidayTemp = 0, 0, 0, 0
+		return nil, mill.ErrorCodeOK, ""
+	}
+	start, err1 := strconv.Atoi(query.Get("holidayStartTime"))
+	end, err2 := strconv.Atoi(query.Get("holidayEndTime"))
+	temp, err3 := strconv.Atoi(query.Get("holidayTemp"))
+	if err1 != nil || err2 != nil || err3 != nil || end <= start {
+		return nil, 1, "invalid holiday"
+	}
+	home.IsHoliday, home.HolidayStartTime, home.HolidayEndTime, home.HolidayTemp = 1, start, end, temp
+	return nil, mill.ErrorCodeOK, ""
+}
+
+func (s *Server) changeHomeMode(r *http.Request) (interface{}, int, string) {
+	query := r.URL.Query()
+	homeID, err := strconv.ParseInt(query.Get("homeId"), 10, 64)
+	if err != nil {
+		return nil, 1, "invalid homeId"
+	}
+	mode, err1 := strconv.Atoi(query.Get("mode"))
+	modeHour, err2 := strconv.Atoi(query.Get("modeHour"))
+	modeMinute, err3 := strconv.Atoi(query.Get("modeMinute"))
+	if err1 != nil || err2 != nil || err3 != nil {
+		return nil, 1, "invalid mode"
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	home := s.findHome(homeID)
+	if home == nil {
+		return nil, 1, "home not found"
+	}
+	home.CurrentMode, home.ModeHour, home.ModeMinute = mode, modeHour, modeMinute
+	home.ModeStartTime = toMillis(time.Now())
+	return nil, mill.ErrorCodeOK, ""
+}
+
+func (s *Server) partnerAuthCode(r *http.Request) (interface{}, int, string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if r.Header.Get("Authorization") != "Bearer "+s.hubToken {
+		return nil, mill.ErrorCodeInvalidCredentials, "invalid hub token"
+	}
+	return map[string]interface{}{"authorization_code": s.authCode}, mill.ErrorCodeOK, ""
+}
+
+// findDevice must be called with mu held
+func (s *Server) findDevice(deviceID int64) *mill.Device {
+	for _, lists := range []map[int64][]mill.Device{s.devices, s.independentDevices} {
+		for id := range lists {
+			for i := range lists[id] {
+				if lists[id][i].DeviceID == deviceID {
+					return &lists[id][i]
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// findHome must be called with mu held
+func (s *Server) findHome(homeID int64) *mill.Home {
+	for i := range s.homes {
+		if s.homes[i].HomeID == homeID {
+			return &s.homes[i]
+		}
+	}
+	return nil
+}
+
+// findRoom must be called with mu held
+func (s *Server) findRoom(roomID int64) *mill.Room {
+	for homeID := range s.rooms {
+		for i := range s.rooms[homeID] {
+			if s.rooms[homeID][i].RoomID == roomID {
+				return &s.rooms[homeID][i]
+			}
+		}
+	}
+	return nil
+}
+
+func writeResponse(w http.ResponseWriter, data interface{}, errorCode int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"errorCode": errorCode,
+		"message":   message,
+		"success":   errorCode == mill.ErrorCodeOK,
+		"data":      data,
+	})
+}
+
+func toMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
@@ -0,0 +1,96 @@
+package mill
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RetryPolicy controls how failed requests are retried.
+// Reads are retried on any temporary failure. Control and token requests are only retried when Mill
+// can't have processed them, e.g. when the connection was refused or the request was rate limited.
+type RetryPolicy struct {
+	MaxAttempts int           // total number of attempts, 1 disables retries
+	BaseDelay   time.Duration // delay before the first retry, doubled for every following retry
+	MaxDelay    time.Duration // upper bound for the delay, also for delays from Retry-After
+}
+
+// DefaultRetryPolicy is used by clients created without WithRetryPolicy
+var DefaultRetryPolicy = RetryPolicy{MaxAttempts: 3, BaseDelay: 1 * time.Second, MaxDelay: 30 * time.Second}
+
+// idempotentEndpoints are safe to repeat after any temporary failure
+var idempotentEndpoints = map[string]bool{
+	EndpointSelectHomeList:        true,
+	EndpointSelectRoombyHome:      true,
+	EndpointSelectDevicebyRoom:    true,
+	EndpointGetIndependentDevices: true,
+}
+
+// next returns how long to wait before the next attempt, and false if the request should not be retried
+func (p RetryPolicy) next(ctx context.Context, endpoint string, attempt int, err error) (time.Duration, bool) {
+	if attempt >= p.MaxAttempts || ctx.Err() != nil {
+		return 0, false
+	}
+	if idempotentEndpoints[endpoint] {
+		if !isTemporary(err) {
+			return 0, false
+		}
+	} else if !isNotProcessed(err) {
+		return 0, false
+	}
+
+	delay := p.BaseDelay << uint(attempt-1)
+	if delay <= 0 || delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	// full jitter in the upper half, so concurrent clients don't retry in lockstep
+	if delay > 1 {
+		delay = delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+	}
+	var apiErr *APIError
+	if errors.As(err, &apiErr) && apiErr.retryAfter > delay {
+		delay = apiErr.retryAfter
+		if delay > p.MaxDelay {
+			delay = p.MaxDelay
+		}
+	}
+	return delay, true
+}
+
+// isTemporary reports failures which may succeed if the request is repeated
+func isTemporary(err error) bool {
+	return errors.Is(err, ErrUnavailable) || errors.Is(err, ErrRateLimited)
+}
+
+// isNotProcessed reports failures where Mill has not acted on the request
+func isNotProcessed(err error) bool {
+	if errors.Is(err, ErrRateLimited) {
+		return true
+	}
+	var apiErr *APIError
+	if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusServiceUnavailable {
+		return true
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// parseRetryAfter accepts both forms of the Retry-After header, delay in seconds and http date
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		if delay := time.Until(date); delay > 0 {
+			return delay
+		}
+	}
+	return 0
+}
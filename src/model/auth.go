@@ -1,9 +1,15 @@
 package model
 
+import "errors"
+
+// ErrEncryptedLogin rejects logins flagged as encrypted. There is no scheme yet for clients to encrypt the password
+// for the hub, the secrets key never leaves it.
+var ErrEncryptedLogin = errors.New("encrypted login passwords are not supported, send the password over the local MQTT connection")
+
 type Login struct {
 	Username  string `json:"username"`
 	Password  string `json:"password"`
-	Encrypted bool   `json:"encrypted"`
+	Encrypted bool   `json:"encrypted"` // always rejected with ErrEncryptedLogin
 }
 
 type SetTokens struct {
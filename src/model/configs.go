@@ -3,45 +3,91 @@ package model
 import (
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
+	"math"
 	"os"
 	"path/filepath"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/futurehomeno/fimpgo"
+	fimputils "github.com/futurehomeno/fimpgo/utils"
 	log "github.com/sirupsen/logrus"
+	mill "github.com/thingsplex/mill/millapi"
 	"github.com/thingsplex/mill/utils"
 )
 
 const ServiceName = "mill"
 
+// API profiles select which Mill and partner API hosts the adapter talks to.
+// An empty profile is resolved from the hub environment.
+const (
+	APIProfileProd   = "prod"
+	APIProfileBeta   = "beta"
+	APIProfileCustom = "custom"
+
+	millAPIURLProd    = "https://api.millheat.com/"
+	partnerAPIURLProd = "https://partners.futurehome.io/"
+	partnerAPIURLBeta = "https://partners-beta.futurehome.io/"
+)
+
+// Defaults for the cache-age thresholds. The poller refreshes the cache every poll_time_min, so with the
+// default poll time reads are normally served from the cache.
+const (
+	defaultCacheMaxAge = 10 * time.Minute
+	defaultFreshMaxAge = 10 * time.Second
+
+	defaultReportHeartbeat = time.Hour
+	// defaultSetpointMaxTemp is used when Configs.SetpointMaxTemp is not set
+	defaultSetpointMaxTemp = 35.0
+	// defaultModeSyncDuration is how long a Mill home mode set from the Futurehome house mode lasts
+	defaultModeSyncDuration = 24 * time.Hour
+)
+
+// Configs is shared by the router, the poller and the token manager. Fields which change at runtime (poll time,
+// log level, credentials, Auth, UID and the report fields) must only be read and written through the methods
+// below, which hold mu. Other fields are only set while loading.
 type Configs struct {
+	mu                 *sync.RWMutex
 	path               string
-	InstanceAddress    string `json:"instance_address"`
-	MqttServerURI      string `json:"mqtt_server_uri"`
-	MqttUsername       string `json:"mqtt_server_username"`
-	MqttPassword       string `json:"mqtt_server_password"`
-	MqttClientIdPrefix string `json:"mqtt_client_id_prefix"`
-	LogFile            string `json:"log_file"`
-	LogLevel           string `json:"log_level"`
-	LogFormat          string `json:"log_format"`
-	WorkDir            string `json:"-"`
-	ConfiguredAt       string `json:"configured_at"`
-	ConfiguredBy       string `json:"configured_by"`
-	Param1             bool   `json:"param_1"`
-	Param2             string `json:"param_2"`
-	PollTimeMin        string `json:"poll_time_min"`
+	secrets            *Secrets
+	apiProfile         string  // APIProfile resolved while loading, see GetAPIProfile
+	SchemaVersion      int     `json:"schema_version"`
+	InstanceAddress    string  `json:"instance_address"`
+	MqttServerURI      string  `json:"mqtt_server_uri"`
+	MqttUsername       string  `json:"mqtt_server_username"`
+	MqttPassword       string  `json:"mqtt_server_password"`
+	MqttClientIdPrefix string  `json:"mqtt_client_id_prefix"`
+	LogFile            string  `json:"log_file"`
+	LogLevel           string  `json:"log_level"`
+	LogFormat          string  `json:"log_format"`
+	WorkDir            string  `json:"-"`
+	ConfiguredAt       string  `json:"configured_at"`
+	ConfiguredBy       string  `json:"configured_by"`
+	Param1             bool    `json:"param_1"`
+	Param2             string  `json:"param_2"`
+	PollTimeMin        string  `json:"poll_time_min"`
+	APIProfile         string  `json:"api_profile"`          // prod, beta, custom or empty to follow the hub environment
+	MillAPIURL         string  `json:"mill_api_url"`         // used by the custom profile
+	PartnerAPIURL      string  `json:"partner_api_url"`      // used by the custom profile
+	APIMaxAttempts     int     `json:"api_max_attempts"`     // attempts per Mill request, 0 uses the client default
+	RefreshWarnDays    int     `json:"refresh_warn_days"`    // days before the 30 day refresh token expires to ask the user to log in again
+	CacheMaxAgeSec     int     `json:"cache_max_age_sec"`    // cached devices older than this are refreshed before a command reads them, 0 uses the default
+	FreshMaxAgeSec     int     `json:"fresh_max_age_sec"`    // commands which need fresh data, like sync, refresh devices older than this, 0 uses the default
+	ReportTempDelta    float64 `json:"report_temp_delta"`    // smallest temperature change in C which is reported by the poller, 0 reports any change
+	ReportHeartbeatMin int     `json:"report_heartbeat_min"` // unchanged values are reported again after this many minutes, 0 uses the default
+
+	SetpointResolutions map[string]float64 `json:"setpoint_resolutions"` // setpoint step in C per Mill device model (subDomainId), overrides mill.DefaultSetpointResolutions
+	SetpointMaxTemp     float64            `json:"setpoint_max_temp"`    // safety limit in C for setpoints of all devices, 0 uses the default
+
+	ModeSync            bool              `json:"mode_sync"`              // follow the Futurehome house mode with the Mill home mode
+	ModeSyncMap         map[string]string `json:"mode_sync_map"`          // Mill home mode per Futurehome house mode, empty uses the default map
+	ModeSyncDurationMin int               `json:"mode_sync_duration_min"` // how long a home mode set by mode_sync lasts, 0 uses the default
 
 	Username string `json:"username"` // this should be moved
 	Password string `json:"password"` // this should be moved
 
-	Auth struct {
-		AuthorizationCode string `json:"authorization_code"` // this should be moved
-		AccessToken       string `json:"access_token"`       // this should be moved
-		RefreshToken      string `json:"refresh_token"`      // this should be moved
-		ExpireTime        int64  `json:"expireTime"`         // this should be moved
-		RefreshExpireTime int64  `json:"refresh_expireTime"` // this should be moved
-	}
+	Auth AuthConfig // owned by TokenManager
 
 	ConnectionState string `json:"connection_state"`
 	Errors          string `json:"errors"`
@@ -49,8 +95,17 @@ type Configs struct {
 	UID             string `json:"uid"`
 }
 
+// AuthConfig holds the Mill authorization code and tokens
+type AuthConfig struct {
+	AuthorizationCode string `json:"authorization_code"` // this should be moved
+	AccessToken       string `json:"access_token"`       // this should be moved
+	RefreshToken      string `json:"refresh_token"`      // this should be moved
+	ExpireTime        int64  `json:"expireTime"`         // this should be moved
+	RefreshExpireTime int64  `json:"refresh_expireTime"` // this should be moved
+}
+
 func NewConfigs(workDir string) *Configs {
-	conf := &Configs{WorkDir: workDir}
+	conf := &Configs{mu: &sync.RWMutex{}, WorkDir: workDir}
 	conf.path = filepath.Join(workDir, "data", "config.json")
 	if !utils.FileExists(conf.path) {
 		log.Info("Config file doesn't exist.Loading default config")
@@ -65,7 +120,13 @@ func NewConfigs(workDir string) *Configs {
 }
 
 func (cf *Configs) LoadFromFile() error {
-	configFileBody, err := ioutil.ReadFile(cf.path)
+	cf.mu.Lock()
+	defer cf.mu.Unlock()
+	configFileBody, err := readJSONFile(cf.path)
+	if err != nil {
+		return err
+	}
+	configFileBody, err = migrateFile(cf.path, configFileBody, configMigrations, ConfigSchemaVersion, cf.encryptFileSecrets)
 	if err != nil {
 		return err
 	}
@@ -73,18 +134,186 @@ func (cf *Configs) LoadFromFile() error {
 	if err != nil {
 		return err
 	}
+	plaintext, err := cf.decryptSecrets()
+	if err != nil {
+		return err
+	}
+	cf.apiProfile = cf.resolveAPIProfile()
+	if plaintext {
+		log.Info("Encrypting credentials in config file")
+		// the replaced file holds the plaintext values, so the encrypted file becomes the last-good backup
+		if err := cf.saveToFile(true); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
 func (cf *Configs) SaveToFile() error {
+	cf.mu.Lock()
+	defer cf.mu.Unlock()
+	return cf.saveToFile(false)
+}
+
+// Update runs change with the configs locked and saves them
+func (cf *Configs) Update(change func(cf *Configs)) error {
+	cf.mu.Lock()
+	defer cf.mu.Unlock()
+	change(cf)
+	return cf.saveToFile(false)
+}
+
+// Modify runs change with the configs locked, without saving them
+func (cf *Configs) Modify(change func(cf *Configs)) {
+	cf.mu.Lock()
+	defer cf.mu.Unlock()
+	change(cf)
+}
+
+// GetAuth returns a copy of the authorization code and tokens
+func (cf *Configs) GetAuth() AuthConfig {
+	cf.mu.RLock()
+	defer cf.mu.RUnlock()
+	return cf.Auth
+}
+
+// GetCredentials returns the Mill username and password of a pending login
+func (cf *Configs) GetCredentials() (username, password string) {
+	cf.mu.RLock()
+	defer cf.mu.RUnlock()
+	return cf.Username, cf.Password
+}
+
+// GetPollTimeMin returns the configured poll time in minutes, as set by the user
+func (cf *Configs) GetPollTimeMin() string {
+	cf.mu.RLock()
+	defer cf.mu.RUnlock()
+	return cf.PollTimeMin
+}
+
+// GetUID returns the correlation id of the last login request
+func (cf *Configs) GetUID() string {
+	cf.mu.RLock()
+	defer cf.mu.RUnlock()
+	return cf.UID
+}
+
+// saveToFile writes the configs with encrypted secrets. See writeJSONFile for replaceBackup. Must be called with mu held.
+func (cf *Configs) saveToFile(replaceBackup bool) error {
 	cf.ConfiguredBy = "auto"
 	cf.ConfiguredAt = time.Now().Format(time.RFC3339)
-	bpayload, err := json.Marshal(cf)
-	err = ioutil.WriteFile(cf.path, bpayload, 0664)
+	cf.SchemaVersion = ConfigSchemaVersion
+	secrets, err := cf.getSecrets()
 	if err != nil {
 		return err
 	}
-	return err
+	file := *cf
+	for _, field := range file.secretFields() {
+		if *field, err = secrets.Encrypt(*field); err != nil {
+			return err
+		}
+	}
+	return writeJSONFile(cf.path, file, replaceBackup)
+}
+
+// Redacted returns a copy of the configs with all secrets replaced, for config reports and logs
+func (cf *Configs) Redacted() Configs {
+	cf.mu.RLock()
+	redacted := *cf
+	cf.mu.RUnlock()
+	for _, field := range redacted.secretFields() {
+		if *field != "" {
+			*field = RedactedValue
+		}
+	}
+	return redacted
+}
+
+// secretFields returns the fields which are encrypted on disk and redacted in reports
+func (cf *Configs) secretFields() []*string {
+	return []*string{
+		&cf.MqttPassword,
+		&cf.Username,
+		&cf.Password,
+		&cf.Auth.AuthorizationCode,
+		&cf.Auth.AccessToken,
+		&cf.Auth.RefreshToken,
+		&cf.HubToken,
+	}
+}
+
+// secretJSONPaths are the json keys of secretFields, for secrets in raw file content of any schema version
+var secretJSONPaths = [][]string{
+	{"mqtt_server_password"},
+	{"username"},
+	{"password"},
+	{"Auth", "authorization_code"},
+	{"Auth", "access_token"},
+	{"Auth", "refresh_token"},
+	{"token"},
+}
+
+// encryptFileSecrets returns body, the raw content of a config file, with the secret values encrypted.
+// It is used for migration backups, which keep the layout of the original file.
+func (cf *Configs) encryptFileSecrets(body []byte) ([]byte, error) {
+	secrets, err := cf.getSecrets()
+	if err != nil {
+		return nil, err
+	}
+	doc := map[string]interface{}{}
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return nil, err
+	}
+	for _, keys := range secretJSONPaths {
+		parent := doc
+		for _, key := range keys[:len(keys)-1] {
+			parent, _ = parent[key].(map[string]interface{})
+		}
+		name := keys[len(keys)-1]
+		if value, ok := parent[name].(string); ok {
+			if parent[name], err = secrets.Encrypt(value); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return json.Marshal(doc)
+}
+
+// getSecrets loads the hub-local key on first use
+func (cf *Configs) getSecrets() (*Secrets, error) {
+	if cf.secrets == nil {
+		secrets, err := NewSecrets(filepath.Join(cf.WorkDir, "data", secretKeyFileName))
+		if err != nil {
+			return nil, fmt.Errorf("can't load secrets key: %w", err)
+		}
+		cf.secrets = secrets
+	}
+	return cf.secrets, nil
+}
+
+// decryptSecrets decrypts the secret fields in place. It reports whether any of them was stored as plaintext.
+// Values which can't be decrypted, for example after the key file was lost, are cleared, so the user has to log in again.
+func (cf *Configs) decryptSecrets() (bool, error) {
+	secrets, err := cf.getSecrets()
+	if err != nil {
+		return false, err
+	}
+	plaintext := false
+	for _, field := range cf.secretFields() {
+		if *field == "" {
+			continue
+		}
+		if !IsEncrypted(*field) {
+			plaintext = true
+			continue
+		}
+		value, err := secrets.Decrypt(*field)
+		if err != nil {
+			log.Error("Can't decrypt credentials in config file, error: ", err)
+		}
+		*field = value
+	}
+	return plaintext, nil
 }
 
 func (cf *Configs) GetDataDir() string {
@@ -96,6 +325,8 @@ func (cf *Configs) GetDefaultDir() string {
 }
 
 func (cf *Configs) LoadDefaults() error {
+	cf.mu.Lock()
+	defer cf.mu.Unlock()
 	configFile := filepath.Join(cf.WorkDir, "data", "config.json")
 	os.Remove(configFile)
 	log.Info("Config file doesn't exist.Loading default config")
@@ -104,7 +335,7 @@ func (cf *Configs) LoadDefaults() error {
 }
 
 func (cf *Configs) IsConfigured() bool {
-	if cf.Auth.AccessToken != "" {
+	if cf.GetAuth().AccessToken != "" {
 		return true
 	} else {
 		return false
@@ -112,13 +343,155 @@ func (cf *Configs) IsConfigured() bool {
 }
 
 func (cf *Configs) IsAuthenticated() bool {
-	if cf.Auth.AuthorizationCode != "" {
+	if cf.GetAuth().AuthorizationCode != "" {
 		return true
 	} else {
 		return false
 	}
 }
 
+// GetPollInterval returns the poll interval from PollTimeMin, or the default if PollTimeMin is not valid
+func (cf *Configs) GetPollInterval() time.Duration {
+	cf.mu.RLock()
+	pollTimeMin := cf.PollTimeMin
+	cf.mu.RUnlock()
+	minutes, err := ParsePollTime(pollTimeMin)
+	if err != nil {
+		minutes = defaultPollTimeMin
+	}
+	return time.Duration(minutes) * time.Minute
+}
+
+// GetCacheMaxAge returns how old cached devices can be when a command reads them
+func (cf *Configs) GetCacheMaxAge() time.Duration {
+	if cf.CacheMaxAgeSec > 0 {
+		return time.Duration(cf.CacheMaxAgeSec) * time.Second
+	}
+	return defaultCacheMaxAge
+}
+
+// GetFreshMaxAge returns how old cached devices can be for commands which need fresh data
+func (cf *Configs) GetFreshMaxAge() time.Duration {
+	if cf.FreshMaxAgeSec > 0 {
+		return time.Duration(cf.FreshMaxAgeSec) * time.Second
+	}
+	return defaultFreshMaxAge
+}
+
+// GetReportHeartbeat returns how often unchanged values are reported by the poller
+func (cf *Configs) GetReportHeartbeat() time.Duration {
+	if cf.ReportHeartbeatMin > 0 {
+		return time.Duration(cf.ReportHeartbeatMin) * time.Minute
+	}
+	return defaultReportHeartbeat
+}
+
+// GetSetpointRange returns the lowest and highest setpoint in C allowed for device. The device range
+// reported by Mill is capped at the configured safety limit.
+func (cf *Configs) GetSetpointRange(device mill.Device) (float64, float64) {
+	return cf.capSetpointRange(device.SetpointRange())
+}
+
+// GetRoomSetpointRange returns the lowest and highest temperature in C allowed for room, capped like GetSetpointRange
+func (cf *Configs) GetRoomSetpointRange(room mill.Room) (float64, float64) {
+	return cf.capSetpointRange(room.SetpointRange())
+}
+
+func (cf *Configs) capSetpointRange(minTemp, maxTemp float64) (float64, float64) {
+	safetyMax := cf.SetpointMaxTemp
+	if safetyMax <= 0 {
+		safetyMax = defaultSetpointMaxTemp
+	}
+	return minTemp, math.Min(maxTemp, safetyMax)
+}
+
+// GetHolidaySetpointRange returns the lowest and highest holiday temperature in C, capped like GetSetpointRange
+func (cf *Configs) GetHolidaySetpointRange() (float64, float64) {
+	return cf.capSetpointRange(mill.MinSetpoint, mill.DefaultMaxSetpoint)
+}
+
+// GetModeSyncMode returns the Mill home mode name for a Futurehome house mode. It returns false for house modes
+// which are not mapped.
+func (cf *Configs) GetModeSyncMode(houseMode string) (string, bool) {
+	modeMap := cf.ModeSyncMap
+	if len(modeMap) == 0 {
+		modeMap = defaultModeSyncMap
+	}
+	mode, ok := modeMap[houseMode]
+	return mode, ok && mode != ""
+}
+
+// GetModeSyncDuration returns how long a home mode set from the Futurehome house mode lasts
+func (cf *Configs) GetModeSyncDuration() time.Duration {
+	if cf.ModeSyncDurationMin > 0 {
+		return time.Duration(cf.ModeSyncDurationMin) * time.Minute
+	}
+	return defaultModeSyncDuration
+}
+
+// GetSetpointResolutions returns the configured setpoint steps keyed by Mill subDomainId. Invalid entries are skipped.
+func (cf *Configs) GetSetpointResolutions() map[int]float64 {
+	resolutions := make(map[int]float64, len(cf.SetpointResolutions))
+	for model, resolution := range cf.SetpointResolutions {
+		subDomainID, err := strconv.Atoi(model)
+		if err != nil || resolution <= 0 {
+			log.Warnf("Ignoring setpoint resolution %v for device model %q", resolution, model)
+			continue
+		}
+		resolutions[subDomainID] = resolution
+	}
+	return resolutions
+}
+
+// GetAPIProfile returns the API profile resolved by LoadFromFile. Changes of api_profile and of the hub
+// environment take effect after a restart.
+func (cf *Configs) GetAPIProfile() string {
+	cf.mu.RLock()
+	defer cf.mu.RUnlock()
+	if cf.apiProfile == "" {
+		return cf.resolveAPIProfile()
+	}
+	return cf.apiProfile
+}
+
+// resolveAPIProfile returns the configured API profile, falling back to the hub environment when none is set.
+// Hubs which are not in the prod environment, and machines without hub info, use beta unless api_profile is set.
+func (cf *Configs) resolveAPIProfile() string {
+	switch cf.APIProfile {
+	case APIProfileProd, APIProfileBeta, APIProfileCustom:
+		return cf.APIProfile
+	case "":
+	default:
+		log.Warnf("Unknown api profile %q, using hub environment", cf.APIProfile)
+	}
+	hubInfo, err := fimputils.NewHubUtils().GetHubInfo()
+	if err == nil && hubInfo != nil && hubInfo.Environment == fimputils.EnvProd {
+		return APIProfileProd
+	}
+	return APIProfileBeta
+}
+
+// GetMillAPIURL returns the Mill API base url for the active profile
+func (cf *Configs) GetMillAPIURL() string {
+	if cf.GetAPIProfile() == APIProfileCustom && cf.MillAPIURL != "" {
+		return cf.MillAPIURL
+	}
+	return millAPIURLProd
+}
+
+// GetPartnerAPIURL returns the Futurehome partner API base url for the active profile
+func (cf *Configs) GetPartnerAPIURL() string {
+	switch cf.GetAPIProfile() {
+	case APIProfileProd:
+		return partnerAPIURLProd
+	case APIProfileCustom:
+		if cf.PartnerAPIURL != "" {
+			return cf.PartnerAPIURL
+		}
+	}
+	return partnerAPIURLBeta
+}
+
 type ConfigReport struct {
 	OpStatus string    `json:"op_status"`
 	AppState AppStates `json:"app_state"`
@@ -126,12 +499,19 @@ type ConfigReport struct {
 
 func (cf *Configs) GetHubToken(oldMsg *fimpgo.Message) (*fimpgo.Address, *fimpgo.FimpMessage, error) {
 	// mqt := fimpgo.MqttTransport{}
-	err := oldMsg.Payload.GetObjectValue(&cf)
+	login := Login{}
+	err := oldMsg.Payload.GetObjectValue(&login)
 	if err != nil {
 		log.Error("Could not get object value")
 		return nil, nil, err
 	}
-	if cf.Username != "" && cf.Password != "" {
+	if login.Encrypted {
+		return nil, nil, ErrEncryptedLogin
+	}
+	cf.Modify(func(cf *Configs) {
+		cf.Username, cf.Password = login.Username, login.Password
+	})
+	if login.Username != "" && login.Password != "" {
 		// Get hub token
 		val := map[string]interface{}{
 			"site_id":     "",
@@ -0,0 +1,156 @@
+package model
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// plaintextSecrets are the secret values of the legacy config files used by the tests
+var plaintextSecrets = []string{"user@example.com", "hunter2", "auth-code-secret", "access-token-secret", "refresh-token-secret", "hub-token-secret", "mqtt-secret"}
+
+const legacyConfig = `{
+  "mqtt_server_uri": "tcp://localhost:1883",
+  "mqtt_server_password": "mqtt-secret",
+  "poll_time_min": "5",
+  "username": "user@example.com",
+  "password": "hunter2",
+  "token": "hub-token-secret",
+  "Auth": {
+    "authorization_code": "auth-code-secret",
+    "access_token": "access-token-secret",
+    "refresh_token": "refresh-token-secret",
+    "expireTime": 1797724800000
+  }
+}`
+
+// newTestWorkDir creates a work dir with data/config.json set to config
+func newTestWorkDir(t *testing.T, config string) string {
+	t.Helper()
+	workDir, err := ioutil.TempDir("", "mill-model-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(workDir) })
+	if err := os.MkdirAll(filepath.Join(workDir, "data"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if config != "" {
+		if err := ioutil.WriteFile(filepath.Join(workDir, "data", "config.json"), []byte(config), 0664); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return workDir
+}
+
+// assertNoPlaintextSecrets fails if config.json or any backup next to it contains a plaintext secret or is not 0600
+func assertNoPlaintextSecrets(t *testing.T, workDir string) {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join(workDir, "data", "config.json*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		body, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, secret := range plaintextSecrets {
+			if strings.Contains(string(body), secret) {
+				t.Errorf("%s contains the plaintext secret %q", filepath.Base(file), secret)
+			}
+		}
+		info, err := os.Stat(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if perm := info.Mode().Perm(); perm != persistedFilePerm {
+			t.Errorf("%s has mode %o, want %o", filepath.Base(file), perm, persistedFilePerm)
+		}
+	}
+}
+
+func TestLoadLegacyConfigEncryptsBackups(t *testing.T) {
+	workDir := newTestWorkDir(t, legacyConfig)
+	cf := NewConfigs(workDir)
+	if err := cf.LoadFromFile(); err != nil {
+		t.Fatal(err)
+	}
+	if cf.Password != "hunter2" || cf.Auth.RefreshToken != "refresh-token-secret" {
+		t.Errorf("secrets not loaded, password %q, refresh token %q", cf.Password, cf.Auth.RefreshToken)
+	}
+	assertNoPlaintextSecrets(t, workDir)
+
+	// the migration backup keeps the original layout and can be decrypted
+	body, err := ioutil.ReadFile(filepath.Join(workDir, "data", "config.json.v0.bak"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	backup := Configs{}
+	if err := json.Unmarshal(body, &backup); err != nil {
+		t.Fatal(err)
+	}
+	if backup.SchemaVersion != 0 {
+		t.Errorf("backup has schema version %d, want 0", backup.SchemaVersion)
+	}
+	if password, err := cf.secrets.Decrypt(backup.Password); err != nil || password != "hunter2" {
+		t.Errorf("backup password decrypts to %q, %v", password, err)
+	}
+}
+
+func TestLoadPlaintextConfigEncryptsBackups(t *testing.T) {
+	workDir := newTestWorkDir(t, strings.Replace(legacyConfig, "{", `{"schema_version": 2,`, 1))
+	cf := NewConfigs(workDir)
+	if err := cf.LoadFromFile(); err != nil {
+		t.Fatal(err)
+	}
+	assertNoPlaintextSecrets(t, workDir)
+
+	// the encrypted file is kept as the last-good backup
+	backup, err := ioutil.ReadFile(backupPath(cf.path))
+	if err != nil {
+		t.Fatal("no last-good backup: ", err)
+	}
+	if !json.Valid(backup) || !strings.Contains(string(backup), encryptedPrefix) {
+		t.Errorf("last-good backup is not the encrypted config: %s", backup)
+	}
+}
+
+func TestSecretJSONPathsCoverSecretFields(t *testing.T) {
+	workDir := newTestWorkDir(t, "")
+	cf := &Configs{WorkDir: workDir}
+	for i, field := range cf.secretFields() {
+		*field = "secret-" + string(rune('a'+i))
+	}
+	body, err := json.Marshal(cf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted, err := cf.encryptFileSecrets(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(encrypted), "secret-") {
+		t.Errorf("secretJSONPaths misses secret fields: %s", encrypted)
+	}
+}
+
+func TestAPIProfileIsResolvedOnLoad(t *testing.T) {
+	workDir := newTestWorkDir(t, `{"schema_version": 2, "api_profile": "custom", "mill_api_url": "http://localhost:8080/"}`)
+	cf := NewConfigs(workDir)
+	if err := cf.LoadFromFile(); err != nil {
+		t.Fatal(err)
+	}
+	cf.Modify(func(cf *Configs) {
+		cf.APIProfile = APIProfileProd
+	})
+	if profile := cf.GetAPIProfile(); profile != APIProfileCustom {
+		t.Errorf("profile %q, want the profile loaded at startup", profile)
+	}
+	if url := cf.GetMillAPIURL(); url != "http://localhost:8080/" {
+		t.Errorf("mill api url %q, want the custom url", url)
+	}
+}
@@ -0,0 +1,92 @@
+package model
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	mill "github.com/thingsplex/mill/millapi"
+)
+
+// disconnectAfterFailures is how many Mill requests in a row have to fail before the connection is reported as DISCONNECTED.
+// Fewer failures are reported as CONNECTING, while the adapter keeps retrying.
+const disconnectAfterFailures = 3
+
+// ConnectivityMonitor derives the connection state of the Mill cloud link from the results of Mill API requests
+// and keeps it in Lifecycle. It is safe for concurrent use.
+type ConnectivityMonitor struct {
+	mu        sync.Mutex
+	lifecycle *Lifecycle
+	failures  int
+	notifier  func(state State)
+}
+
+func NewConnectivityMonitor(lifecycle *Lifecycle) *ConnectivityMonitor {
+	return &ConnectivityMonitor{lifecycle: lifecycle}
+}
+
+// SetNotifier sets a function called whenever the connection state changes
+func (cm *ConnectivityMonitor) SetNotifier(notifier func(state State)) {
+	cm.mu.Lock()
+	cm.notifier = notifier
+	cm.mu.Unlock()
+}
+
+// Connecting resets the failure count and reports CONNECTING until the next request completes, e.g. at startup
+func (cm *ConnectivityMonitor) Connecting(reason string) {
+	cm.mu.Lock()
+	cm.failures = 0
+	cm.mu.Unlock()
+	cm.set(ConnStateConnecting, reason)
+}
+
+// Disconnected resets the failure count and reports DISCONNECTED, e.g. when the adapter is not logged in
+func (cm *ConnectivityMonitor) Disconnected(reason string) {
+	cm.mu.Lock()
+	cm.failures = 0
+	cm.mu.Unlock()
+	cm.set(ConnStateDisconnected, reason)
+}
+
+// Record updates the connection state with the result of a Mill API request. Any response from Mill,
+// including an error response, counts as reachable. Canceled requests are ignored.
+func (cm *ConnectivityMonitor) Record(endpoint string, err error) {
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+	if !isUnreachable(err) {
+		cm.mu.Lock()
+		cm.failures = 0
+		cm.mu.Unlock()
+		cm.set(ConnStateConnected, "response from "+endpoint)
+		return
+	}
+	cm.mu.Lock()
+	cm.failures++
+	failures := cm.failures
+	cm.mu.Unlock()
+	if failures >= disconnectAfterFailures {
+		cm.set(ConnStateDisconnected, err.Error())
+	} else {
+		cm.set(ConnStateConnecting, err.Error())
+	}
+}
+
+func (cm *ConnectivityMonitor) set(state State, reason string) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if cm.lifecycle.ConnectionState() == state {
+		return
+	}
+	cm.lifecycle.SetConnectionState(state, reason)
+	log.Infof("<conn> Mill cloud connection is %s (%s)", state, reason)
+	if cm.notifier != nil {
+		cm.notifier(state)
+	}
+}
+
+// isUnreachable reports whether err means that Mill couldn't be reached or didn't answer in time
+func isUnreachable(err error) bool {
+	return errors.Is(err, mill.ErrUnavailable) || errors.Is(err, context.DeadlineExceeded)
+}
@@ -0,0 +1,81 @@
+package model
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	mill "github.com/thingsplex/mill/millapi"
+)
+
+// Adapter error codes, reported in AppStates.LastErrorCode and evt.app.error_report
+const (
+	AppErrorAuthFailed       = "auth_failed"
+	AppErrorTokenExpired     = "token_expired"
+	AppErrorTokenExpiring    = "token_expiring"
+	AppErrorCloudUnreachable = "cloud_unreachable"
+	AppErrorRateLimited      = "rate_limited"
+	AppErrorDeviceOffline    = "device_offline"
+	AppErrorBadResponse      = "bad_response"
+	AppErrorInvalidConfig    = "invalid_config"
+	AppErrorInternal         = "internal_error"
+)
+
+// appErrorTexts is the catalog of user facing texts for each error code
+var appErrorTexts = map[string]string{
+	AppErrorAuthFailed:       "Mill rejected the username or password. Log in again in the Mill app settings.",
+	AppErrorTokenExpired:     "Mill login has expired. Log in again in the Mill app settings.",
+	AppErrorTokenExpiring:    "Mill login expires soon. Log in again in the Mill app settings.",
+	AppErrorCloudUnreachable: "Mill cloud can't be reached.",
+	AppErrorRateLimited:      "Mill cloud is limiting requests, retrying later.",
+	AppErrorDeviceOffline:    "A Mill heater is offline.",
+	AppErrorBadResponse:      "Mill cloud sent an unexpected response.",
+	AppErrorInvalidConfig:    "Invalid app configuration.",
+	AppErrorInternal:         "Internal adapter error.",
+}
+
+// apiErrorCodes are the codes set from Mill API failures. They are cleared by the next successful request.
+var apiErrorCodes = []string{AppErrorAuthFailed, AppErrorTokenExpired, AppErrorCloudUnreachable, AppErrorRateLimited, AppErrorDeviceOffline, AppErrorBadResponse}
+
+// AppError is the current adapter error
+type AppError struct {
+	Code string    `json:"code"`
+	Text string    `json:"text"`
+	Time time.Time `json:"time"`
+}
+
+// AppErrorText returns the catalog text for code
+func AppErrorText(code string) string {
+	if text, ok := appErrorTexts[code]; ok {
+		return text
+	}
+	return appErrorTexts[AppErrorInternal]
+}
+
+// isRecoverableTokenError reports whether err is an expired access token, which TokenManager refreshes, or a missing
+// login, which is expected until the user logs in. TokenManager sets token_expired or auth_failed itself when
+// a refresh or a login actually fails.
+func isRecoverableTokenError(err error) bool {
+	return errors.Is(err, mill.ErrTokenExpired) || errors.Is(err, ErrNotAuthenticated)
+}
+
+// AppErrorCode classifies an error returned by millapi or the token manager. Canceled requests have no code.
+func AppErrorCode(err error) string {
+	switch {
+	case err == nil, errors.Is(err, context.Canceled):
+		return ""
+	case errors.Is(err, mill.ErrInvalidCredentials), errors.Is(err, ErrNotAuthenticated):
+		return AppErrorAuthFailed
+	case errors.Is(err, mill.ErrTokenExpired), errors.Is(err, ErrRefreshTokenExpired):
+		return AppErrorTokenExpired
+	case errors.Is(err, mill.ErrUnavailable), errors.Is(err, context.DeadlineExceeded):
+		return AppErrorCloudUnreachable
+	case errors.Is(err, mill.ErrRateLimited):
+		return AppErrorRateLimited
+	case errors.Is(err, mill.ErrDeviceOffline):
+		return AppErrorDeviceOffline
+	case errors.Is(err, mill.ErrBadResponse), errors.Is(err, mill.ErrUnsupportedMode):
+		return AppErrorBadResponse
+	}
+	return AppErrorInternal
+}
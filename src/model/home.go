@@ -0,0 +1,101 @@
+package model
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	mill "github.com/thingsplex/mill/millapi"
+)
+
+// FIMP names of the Mill home modes
+const (
+	HomeModeProgram = "program"
+	HomeModeComfort = "comfort"
+	HomeModeSleep   = "sleep"
+	HomeModeAway    = "away"
+)
+
+var homeModes = map[string]int{
+	HomeModeProgram: mill.ModeProgram,
+	HomeModeComfort: mill.ModeComfort,
+	HomeModeSleep:   mill.ModeSleep,
+	HomeModeAway:    mill.ModeAway,
+}
+
+// defaultModeSyncMap maps Futurehome house modes to Mill home modes when Configs.ModeSyncMap is empty
+var defaultModeSyncMap = map[string]string{
+	"home":     HomeModeProgram,
+	"sleep":    HomeModeSleep,
+	"away":     HomeModeAway,
+	"vacation": HomeModeAway,
+}
+
+// holidayDateLayout is the date only format accepted for holiday start and end
+const holidayDateLayout = "2006-01-02"
+
+// HomeReport is the state of a Mill home sent in evt.home.report
+type HomeReport struct {
+	HomeID          string `json:"home_id"`
+	Name            string `json:"name"`
+	Mode            string `json:"mode"`
+	ModeDurationMin int    `json:"mode_duration_min"` // how long a forced mode lasts, 0 when following the program
+	Holiday         bool   `json:"holiday"`
+	HolidayStart    string `json:"holiday_start,omitempty"`
+	HolidayEnd      string `json:"holiday_end,omitempty"`
+	HolidayTemp     int    `json:"holiday_temp,omitempty"`
+}
+
+// ParseHomeMode returns the Mill mode of a FIMP home mode name
+func ParseHomeMode(name string) (int, error) {
+	mode, ok := homeModes[name]
+	if !ok {
+		return 0, fmt.Errorf("home mode %q is not supported, only %s, %s, %s or %s", name, HomeModeProgram, HomeModeComfort, HomeModeSleep, HomeModeAway)
+	}
+	return mode, nil
+}
+
+// HomeModeName returns the FIMP name of a Mill home mode
+func HomeModeName(mode int) string {
+	for name, m := range homeModes {
+		if m == mode {
+			return name
+		}
+	}
+	return HomeModeProgram
+}
+
+// ParseHolidayTime reads a holiday start or end, either RFC 3339 or a date in local time. A date means the start
+// of the day, or the end of the day if isEnd is set, so a holiday from 2026-12-20 to 2026-12-27 includes both days.
+func ParseHolidayTime(value string, isEnd bool) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	day, err := time.ParseInLocation(holidayDateLayout, value, time.Local)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%q is not a date (YYYY-MM-DD) or RFC 3339 time", value)
+	}
+	if isEnd {
+		day = day.AddDate(0, 0, 1)
+	}
+	return day, nil
+}
+
+// NewHomeReport describes home for evt.home.report
+func NewHomeReport(home mill.Home) HomeReport {
+	report := HomeReport{
+		HomeID: strconv.FormatInt(home.HomeID, 10),
+		Name:   home.HomeName,
+		Mode:   HomeModeName(home.CurrentMode),
+	}
+	if home.CurrentMode != mill.ModeProgram {
+		report.ModeDurationMin = home.ModeHour*60 + home.ModeMinute
+	}
+	if home.IsHoliday != 0 {
+		report.Holiday = true
+		report.HolidayStart = time.Unix(int64(home.HolidayStartTime), 0).Format(time.RFC3339)
+		report.HolidayEnd = time.Unix(int64(home.HolidayEndTime), 0).Format(time.RFC3339)
+		report.HolidayTemp = home.HolidayTemp
+	}
+	return report
+}
@@ -1,14 +1,18 @@
 package model
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"sync"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 )
 
 //
 // Events : STATING -> CONFIGURING -> CONFIGURED -> RUNNING
-// States : CONFIGURING -> RUNNING  / CONFIGURING -> NOT_CONFIGURED /
+// States : see appStateTransitions
 
 const (
 	SystemEventTypeEvent = "EVENT"
@@ -46,6 +50,30 @@ const (
 
 type State string
 
+// maxStateHistory is how many state transitions Lifecycle keeps for diagnostics
+const maxStateHistory = 50
+
+// State kinds used in StateTransition
+const (
+	StateKindApp        = "app"
+	StateKindConfig     = "config"
+	StateKindAuth       = "auth"
+	StateKindConnection = "connection"
+)
+
+// appStateTransitions lists the app states each app state may move to. TERMINATING is final.
+var appStateTransitions = map[State][]State{
+	AppStateStarting:      {AppStateNotConfigured, AppStateRunning, AppStateStartupError, AppStateError, AppStateTerminate},
+	AppStateNotConfigured: {AppStateRunning, AppStateError, AppStateTerminate},
+	AppStateRunning:       {AppStateNotConfigured, AppStateError, AppStateTerminate},
+	AppStateError:         {AppStateRunning, AppStateNotConfigured, AppStateTerminate},
+	AppStateStartupError:  {AppStateTerminate},
+	AppStateTerminate:     {},
+}
+
+// ErrInvalidTransition is returned by SetAppState when the new app state can't follow the current one
+var ErrInvalidTransition = errors.New("invalid app state transition")
+
 type AppStates struct {
 	App           string `json:"app"`
 	Connection    string `json:"connection"`
@@ -55,6 +83,15 @@ type AppStates struct {
 	LastErrorCode string `json:"last_error_code"`
 }
 
+// StateTransition is one change of the app, config, auth or connection state
+type StateTransition struct {
+	Time   time.Time `json:"time"`
+	Kind   string    `json:"kind"`
+	From   State     `json:"from"`
+	To     State     `json:"to"`
+	Reason string    `json:"reason"`
+}
+
 type SystemEvent struct {
 	Type   string
 	Name   string
@@ -65,21 +102,107 @@ type SystemEvent struct {
 
 type SystemEventChannel chan SystemEvent
 
+// Lifecycle holds the app, config, auth and connection states. All methods are safe for concurrent use.
 type Lifecycle struct {
 	busMux           sync.Mutex
 	systemEventBus   map[string]SystemEventChannel
+	mu               sync.RWMutex
 	appState         State
 	previousAppState State
-	lastError        string
+	lastError        AppError
+	errorNotifier    func(AppError)
 	connectionState  State
 	authState        State
 	configState      State
+	history          []StateTransition
 }
 
+// LastError returns the text of the current error, or "" if there is none
 func (al *Lifecycle) LastError() string {
+	al.mu.RLock()
+	defer al.mu.RUnlock()
+	return al.lastError.Text
+}
+
+// CurrentError returns the current error. Code is empty if there is none.
+func (al *Lifecycle) CurrentError() AppError {
+	al.mu.RLock()
+	defer al.mu.RUnlock()
 	return al.lastError
 }
 
+// SetErrorNotifier sets a function called whenever the current error changes or is cleared
+func (al *Lifecycle) SetErrorNotifier(notifier func(AppError)) {
+	al.mu.Lock()
+	al.errorNotifier = notifier
+	al.mu.Unlock()
+}
+
+// SetError makes code the current error. An empty text is replaced with the catalog text for code.
+func (al *Lifecycle) SetError(code, text string) {
+	if text == "" {
+		text = AppErrorText(code)
+	}
+	al.mu.Lock()
+	if al.lastError.Code == code && al.lastError.Text == text {
+		al.mu.Unlock()
+		return
+	}
+	al.lastError = AppError{Code: code, Text: text, Time: time.Now()}
+	appErr, notifier := al.lastError, al.errorNotifier
+	al.mu.Unlock()
+	log.Warnf("<sysEvt> Error %s: %s", code, text)
+	if notifier != nil {
+		notifier(appErr)
+	}
+}
+
+// RecordError classifies err with AppErrorCode and makes it the current error. Canceled requests are ignored, and so
+// are token errors which TokenManager recovers from, see isRecoverableTokenError.
+func (al *Lifecycle) RecordError(err error) {
+	if isRecoverableTokenError(err) {
+		return
+	}
+	if code := AppErrorCode(err); code != "" {
+		al.SetError(code, "")
+	}
+}
+
+// ClearError clears the current error if its code is one of codes, or any error if no codes are given
+func (al *Lifecycle) ClearError(codes ...string) {
+	al.mu.Lock()
+	if al.lastError.Code == "" || (len(codes) > 0 && !containsCode(codes, al.lastError.Code)) {
+		al.mu.Unlock()
+		return
+	}
+	log.Infof("<sysEvt> Error %s cleared", al.lastError.Code)
+	al.lastError = AppError{Time: time.Now()}
+	appErr, notifier := al.lastError, al.errorNotifier
+	al.mu.Unlock()
+	if notifier != nil {
+		notifier(appErr)
+	}
+}
+
+// RecordAPIResult sets or clears the current error from the overall result of a poll or a command.
+// Single requests are recorded with RecordError, so one successful request doesn't hide a failed one.
+func (al *Lifecycle) RecordAPIResult(err error) {
+	if err == nil {
+		al.ClearError(apiErrorCodes...)
+		return
+	}
+	al.RecordError(err)
+}
+
+func containsCode(codes []string, code string) bool {
+	for _, c := range codes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
 func NewAppLifecycle() *Lifecycle {
 	lf := &Lifecycle{systemEventBus: make(map[string]SystemEventChannel)}
 	lf.appState = AppStateStarting
@@ -90,63 +213,129 @@ func NewAppLifecycle() *Lifecycle {
 }
 
 func (al *Lifecycle) GetAllStates() *AppStates {
+	al.mu.RLock()
+	defer al.mu.RUnlock()
 	appStates := AppStates{
 		App:           string(al.appState),
 		Connection:    string(al.connectionState),
 		Config:        string(al.configState),
 		Auth:          string(al.authState),
-		LastErrorText: "",
-		LastErrorCode: "",
+		LastErrorText: al.lastError.Text,
+		LastErrorCode: al.lastError.Code,
 	}
 	return &appStates
 }
 
+// History returns the recorded state transitions, oldest first
+func (al *Lifecycle) History() []StateTransition {
+	al.mu.RLock()
+	defer al.mu.RUnlock()
+	history := make([]StateTransition, len(al.history))
+	copy(history, al.history)
+	return history
+}
+
+// record appends a transition to the history. al.mu must be held.
+func (al *Lifecycle) record(kind string, from, to State, reason string) {
+	if len(al.history) == maxStateHistory {
+		copy(al.history, al.history[1:])
+		al.history = al.history[:maxStateHistory-1]
+	}
+	al.history = append(al.history, StateTransition{Time: time.Now(), Kind: kind, From: from, To: to, Reason: reason})
+	log.Debugf("<sysEvt> %s state %s -> %s (%s)", kind, from, to, reason)
+}
+
+// setState changes one of the non-app states and records the transition. Setting the current state is a no-op.
+func (al *Lifecycle) setState(kind string, state *State, newState State, reason string) {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	if *state == newState {
+		return
+	}
+	al.record(kind, *state, newState, reason)
+	*state = newState
+}
+
 func (al *Lifecycle) ConfigState() State {
+	al.mu.RLock()
+	defer al.mu.RUnlock()
 	return al.configState
 }
 
-func (al *Lifecycle) SetConfigState(configState State) {
-	al.configState = configState
+func (al *Lifecycle) SetConfigState(configState State, reason string) {
+	al.setState(StateKindConfig, &al.configState, configState, reason)
 }
 
 func (al *Lifecycle) AuthState() State {
+	al.mu.RLock()
+	defer al.mu.RUnlock()
 	return al.authState
 }
 
-func (al *Lifecycle) SetAuthState(authState State) {
-	al.authState = authState
+func (al *Lifecycle) SetAuthState(authState State, reason string) {
+	al.setState(StateKindAuth, &al.authState, authState, reason)
 }
 
 func (al *Lifecycle) ConnectionState() State {
+	al.mu.RLock()
+	defer al.mu.RUnlock()
 	return al.connectionState
 }
 
-func (al *Lifecycle) SetConnectionState(connectivityState State) {
-	al.connectionState = connectivityState
+func (al *Lifecycle) SetConnectionState(connectivityState State, reason string) {
+	al.setState(StateKindConnection, &al.connectionState, connectivityState, reason)
 }
 
 func (al *Lifecycle) AppState() State {
+	al.mu.RLock()
+	defer al.mu.RUnlock()
 	return al.appState
 }
 
-func (al *Lifecycle) SetAppState(currentState State, params map[string]string) {
-	al.busMux.Lock()
+// SetAppState moves the app to a new state and notifies state listeners. It returns ErrInvalidTransition if
+// appStateTransitions doesn't allow the change. Setting the current state is a no-op.
+func (al *Lifecycle) SetAppState(currentState State, reason string) error {
+	al.mu.Lock()
+	if al.appState == currentState {
+		al.mu.Unlock()
+		return nil
+	}
+	if !canTransition(al.appState, currentState) {
+		from := al.appState
+		al.mu.Unlock()
+		log.Warnf("<sysEvt> App state %s -> %s is not allowed (%s)", from, currentState, reason)
+		return fmt.Errorf("%w: %s -> %s", ErrInvalidTransition, from, currentState)
+	}
+	al.record(StateKindApp, al.appState, currentState, reason)
 	al.previousAppState = al.appState
 	al.appState = currentState
+	al.mu.Unlock()
+
 	log.Debug("<sysEvt> New system state = ", currentState)
+	al.busMux.Lock()
 	for i := range al.systemEventBus {
 		select {
-		case al.systemEventBus[i] <- SystemEvent{Type: SystemEventTypeState, State: currentState, Info: "sys", Params: params}:
+		case al.systemEventBus[i] <- SystemEvent{Type: SystemEventTypeState, State: currentState, Info: reason}:
 		default:
 			log.Warnf("<sysEvt> State listener %s is busy , event dropped", i)
 		}
 
 	}
 	al.busMux.Unlock()
+	return nil
+}
+
+func canTransition(from, to State) bool {
+	for _, allowed := range appStateTransitions[from] {
+		if allowed == to {
+			return true
+		}
+	}
+	return false
 }
 
 func (al *Lifecycle) PublishEvent(name, src string, params map[string]string) {
-	event := SystemEvent{Name: name}
+	event := SystemEvent{Name: name, Info: src}
 	al.Publish(event, src, params)
 }
 
@@ -164,7 +353,7 @@ func (al *Lifecycle) Publish(event SystemEvent, src string, params map[string]st
 
 	}
 	al.busMux.Unlock()
-	al.processEvent(event)
+	al.processEvent(event, src)
 }
 
 func (al *Lifecycle) Subscribe(subId string, bufSize int) SystemEventChannel {
@@ -181,33 +370,46 @@ func (al *Lifecycle) Unsubscribe(subId string) {
 	al.busMux.Unlock()
 }
 
-func (al *Lifecycle) processEvent(event SystemEvent) {
+func (al *Lifecycle) processEvent(event SystemEvent, src string) {
+	reason := fmt.Sprintf("%s event from %s", event.Name, src)
 	switch event.Name {
 
 	case EventConfiguring:
-		al.SetAppState(ConfigStateInProgress, nil)
+		al.SetConfigState(ConfigStateInProgress, reason)
 
 	case EventConfigured:
-		al.SetAppState(ConfigStateConfigured, nil)
-		al.SetAppState(AppStateRunning, nil)
+		al.SetConfigState(ConfigStateConfigured, reason)
+		al.SetAppState(AppStateRunning, reason)
 
 	case EventConfigError:
-		al.SetAppState(AppStateNotConfigured, nil)
+		al.SetConfigState(ConfigStateNotConfigured, reason)
+		al.SetAppState(AppStateNotConfigured, reason)
 	}
 
 }
 
 // WaitForState blocks until target state is reached
 func (al *Lifecycle) WaitForState(subId string, targetState State) {
+	al.WaitForStateContext(context.Background(), subId, targetState)
+}
+
+// WaitForStateContext blocks until target state is reached or ctx is done. It returns false if ctx is done first.
+func (al *Lifecycle) WaitForStateContext(ctx context.Context, subId string, targetState State) bool {
 	log.Debugf("<sysEvt> Waiting for state = %s , current state = %s", targetState, al.AppState())
+	// subscribe before checking the current state, so a transition in between isn't missed
+	ch := al.Subscribe(subId, 5)
+	defer al.Unsubscribe(subId)
 	if al.AppState() == targetState {
-		return
+		return true
 	}
-	ch := al.Subscribe(subId, 5)
-	for evt := range ch {
-		if evt.Type == SystemEventTypeState && evt.State == targetState {
-			al.Unsubscribe(subId)
-			return
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case evt := <-ch:
+			if evt.Type == SystemEventTypeState && evt.State == targetState {
+				return true
+			}
 		}
 	}
 }
@@ -0,0 +1,146 @@
+package model
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/thingsplex/mill/utils"
+)
+
+// Schema versions written to config.json and state.json. When a file layout changes, bump the version
+// and register a migration from the previous version below.
+const (
+	ConfigSchemaVersion = 2
+	StateSchemaVersion  = 1
+)
+
+// schemaVersionKey is the json key holding the schema version. Files without it are version 0.
+const schemaVersionKey = "schema_version"
+
+// migration upgrades a decoded file by exactly one schema version
+type migration func(doc map[string]interface{}) error
+
+// configMigrations and stateMigrations are keyed by the version they upgrade from
+var configMigrations = map[int]migration{
+	0: migrateConfigV0,
+	1: migrateConfigV1,
+}
+
+var stateMigrations = map[int]migration{
+	0: migrateStateV0,
+}
+
+// migrateFile upgrades body step by step from its schema version to current. A backup of the original file is
+// written next to path before anything is changed, and the migrated body is written back to path.
+// encodeBackup, if set, converts the original body before it is written to the backup, e.g. to encrypt secrets.
+func migrateFile(path string, body []byte, migrations map[int]migration, current int, encodeBackup func(body []byte) ([]byte, error)) ([]byte, error) {
+	doc := map[string]interface{}{}
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return nil, err
+	}
+	version := 0
+	if v, ok := doc[schemaVersionKey].(float64); ok {
+		version = int(v)
+	}
+	if version == current {
+		return body, nil
+	}
+	backupPath := fmt.Sprintf("%s.v%d.bak", path, version)
+	backup := body
+	if encodeBackup != nil {
+		var err error
+		if backup, err = encodeBackup(body); err != nil {
+			return nil, fmt.Errorf("can't back up %s before migration: %w", path, err)
+		}
+	}
+	if err := utils.WriteFileAtomic(backupPath, backup, persistedFilePerm); err != nil {
+		return nil, fmt.Errorf("can't back up %s before migration: %w", path, err)
+	}
+	if version > current {
+		log.Warnf("<model> %s has schema version %d, newer than supported version %d. Loading it as is, backup in %s", path, version, current, backupPath)
+		return body, nil
+	}
+	for ; version < current; version++ {
+		migrate, ok := migrations[version]
+		if !ok {
+			return nil, fmt.Errorf("no migration for %s from schema version %d", path, version)
+		}
+		if err := migrate(doc); err != nil {
+			return nil, fmt.Errorf("migration of %s from schema version %d failed: %w", path, version, err)
+		}
+		doc[schemaVersionKey] = version + 1
+		log.Infof("<model> Migrated %s to schema version %d", path, version+1)
+	}
+	migrated, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	if err := utils.WriteFileAtomic(path, migrated, persistedFilePerm); err != nil {
+		return nil, err
+	}
+	return migrated, nil
+}
+
+// migrateConfigV0 fills in settings which were added before versioning, so partial files get the same
+// values as a fresh install instead of zero values
+func migrateConfigV0(doc map[string]interface{}) error {
+	defaults := map[string]interface{}{
+		"poll_time_min":     "5",
+		"api_profile":       "",
+		"mill_api_url":      "",
+		"partner_api_url":   "",
+		"api_max_attempts":  3,
+		"refresh_warn_days": defaultRefreshWarnDays,
+	}
+	for key, value := range defaults {
+		if current, ok := doc[key]; !ok || current == nil {
+			doc[key] = value
+		}
+	}
+	// an empty poll time can't be parsed and stops polling
+	if doc["poll_time_min"] == "" {
+		doc["poll_time_min"] = defaults["poll_time_min"]
+	}
+	return nil
+}
+
+// migrateConfigV1 fills in settings which were added after version 1 with the values of defaults/config.json.
+// A missing report_temp_delta would otherwise load as 0, which reports every change.
+func migrateConfigV1(doc map[string]interface{}) error {
+	defaults := map[string]interface{}{
+		"cache_max_age_sec":      600,
+		"fresh_max_age_sec":      10,
+		"report_temp_delta":      0.2,
+		"report_heartbeat_min":   int(defaultReportHeartbeat / time.Minute),
+		"setpoint_resolutions":   map[string]interface{}{},
+		"setpoint_max_temp":      defaultSetpointMaxTemp,
+		"mode_sync":              false,
+		"mode_sync_map":          map[string]interface{}{},
+		"mode_sync_duration_min": int(defaultModeSyncDuration / time.Minute),
+	}
+	for key, value := range defaults {
+		if current, ok := doc[key]; !ok || current == nil {
+			doc[key] = value
+		}
+	}
+	return nil
+}
+
+// migrateStateV0 renames the misspelled IndependentDeviceCollectoin key and drops collections
+// which are not lists, since they can't be decoded into devices
+func migrateStateV0(doc map[string]interface{}) error {
+	if old, ok := doc["IndependentDeviceCollectoin"]; ok {
+		if _, exists := doc["IndependentDeviceCollection"]; !exists {
+			doc["IndependentDeviceCollection"] = old
+		}
+		delete(doc, "IndependentDeviceCollectoin")
+	}
+	for _, key := range []string{"HomeCollection", "RoomCollection", "DeviceCollection", "IndependentDeviceCollection"} {
+		if _, ok := doc[key].([]interface{}); !ok {
+			doc[key] = []interface{}{}
+		}
+	}
+	return nil
+}
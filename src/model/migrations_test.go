@@ -0,0 +1,118 @@
+package model
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestMigrateStateV0(t *testing.T) {
+	workDir := newTestWorkDir(t, "")
+	original := `{"HomeCollection": [{"homeId": 1}], "RoomCollection": null, "DeviceCollection": [{"deviceId": 100}],
+		"IndependentDeviceCollectoin": [{"deviceId": 100}], "device_homes": {"100": 1}}`
+	path := writeTestStateFile(t, workDir, original)
+
+	st := NewStates(workDir)
+	if err := st.LoadFromFile(); err != nil {
+		t.Fatal(err)
+	}
+	if !st.IsIndependent(100) {
+		t.Error("device from IndependentDeviceCollectoin is not independent")
+	}
+	if home, ok := st.DeviceHome(100); !ok || home.HomeID != 1 {
+		t.Errorf("device home %+v, %v, want home 1", home, ok)
+	}
+
+	if backup, _ := ioutil.ReadFile(path + ".v0.bak"); string(backup) != original {
+		t.Errorf("backup is %q, want the original file", backup)
+	}
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc := map[string]interface{}{}
+	if err := json.Unmarshal(body, &doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc[schemaVersionKey] != float64(StateSchemaVersion) {
+		t.Errorf("migrated file has schema version %v, want %d", doc[schemaVersionKey], StateSchemaVersion)
+	}
+	if _, ok := doc["IndependentDeviceCollectoin"]; ok {
+		t.Error("misspelled key kept")
+	}
+	if rooms, ok := doc["RoomCollection"].([]interface{}); !ok || len(rooms) != 0 {
+		t.Errorf("RoomCollection is %v, want an empty list", doc["RoomCollection"])
+	}
+}
+
+func TestMigrateConfigV0FillsDefaults(t *testing.T) {
+	workDir := newTestWorkDir(t, `{"poll_time_min": "", "log_level": "debug"}`)
+	cf := NewConfigs(workDir)
+	if err := cf.LoadFromFile(); err != nil {
+		t.Fatal(err)
+	}
+	if cf.SchemaVersion != ConfigSchemaVersion {
+		t.Errorf("schema version %d, want %d", cf.SchemaVersion, ConfigSchemaVersion)
+	}
+	if cf.GetPollTimeMin() != "5" || cf.RefreshWarnDays != defaultRefreshWarnDays || cf.LogLevel != "debug" {
+		t.Errorf("got poll time %q, refresh warn days %d, log level %q", cf.GetPollTimeMin(), cf.RefreshWarnDays, cf.LogLevel)
+	}
+}
+
+func TestMigrateFileKeepsNewerVersion(t *testing.T) {
+	path := filepath.Join(newTestWorkDir(t, ""), "data", "test.json")
+	body := []byte(`{"schema_version": 9, "future": true}`)
+	loaded, err := migrateFile(path, body, map[int]migration{}, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(loaded) != string(body) {
+		t.Errorf("newer file changed to %s", loaded)
+	}
+	if backup, _ := ioutil.ReadFile(path + ".v9.bak"); string(backup) != string(body) {
+		t.Errorf("backup is %q, want the newer file", backup)
+	}
+
+	// a missing migration is an error, not a silently skipped step
+	if _, err := migrateFile(path, []byte(`{}`), map[int]migration{}, 1, nil); err == nil {
+		t.Error("migration without a registered step succeeded")
+	}
+}
+
+func TestMigrateConfigV1FillsLaterSettings(t *testing.T) {
+	workDir := newTestWorkDir(t, `{"schema_version": 1, "poll_time_min": "10", "report_heartbeat_min": 30}`)
+	cf := NewConfigs(workDir)
+	if err := cf.LoadFromFile(); err != nil {
+		t.Fatal(err)
+	}
+	if cf.ReportTempDelta != 0.2 {
+		t.Errorf("report_temp_delta %v, want the shipped default 0.2", cf.ReportTempDelta)
+	}
+	if cf.SetpointMaxTemp != defaultSetpointMaxTemp || cf.ModeSyncDurationMin != 1440 || cf.CacheMaxAgeSec != 600 {
+		t.Errorf("got setpoint_max_temp %v, mode_sync_duration_min %d, cache_max_age_sec %d, want the shipped defaults", cf.SetpointMaxTemp, cf.ModeSyncDurationMin, cf.CacheMaxAgeSec)
+	}
+	// settings which are present are kept
+	if cf.GetPollTimeMin() != "10" || cf.ReportHeartbeatMin != 30 {
+		t.Errorf("got poll time %q and heartbeat %d, want the values of the file", cf.GetPollTimeMin(), cf.ReportHeartbeatMin)
+	}
+}
+
+func TestMigratedConfigMatchesDefaults(t *testing.T) {
+	shipped, err := ioutil.ReadFile(filepath.Join("..", "..", "package", "debian", "opt", "thingsplex", "mill", "defaults", "config.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fresh := NewConfigs(newTestWorkDir(t, string(shipped)))
+	if err := fresh.LoadFromFile(); err != nil {
+		t.Fatal(err)
+	}
+	migrated := NewConfigs(newTestWorkDir(t, `{}`))
+	if err := migrated.LoadFromFile(); err != nil {
+		t.Fatal(err)
+	}
+	if migrated.ReportTempDelta != fresh.ReportTempDelta || migrated.ReportHeartbeatMin != fresh.ReportHeartbeatMin ||
+		migrated.FreshMaxAgeSec != fresh.FreshMaxAgeSec || migrated.RefreshWarnDays != fresh.RefreshWarnDays {
+		t.Errorf("a migrated empty config differs from a fresh install: %+v, %+v", migrated.Redacted(), fresh.Redacted())
+	}
+}
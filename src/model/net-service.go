@@ -2,16 +2,122 @@ package model
 
 import (
 	"fmt"
-	"reflect"
 	"strconv"
 
 	"github.com/futurehomeno/fimpgo/fimptype"
+	mill "github.com/thingsplex/mill/millapi"
 )
 
+// ThermostatModes are the modes of the thermostat service of a heater
+var ThermostatModes = []string{"off", "heat"}
+
+// IsThermostatMode reports whether mode is one of ThermostatModes
+func IsThermostatMode(mode string) bool {
+	for _, m := range ThermostatModes {
+		if m == mode {
+			return true
+		}
+	}
+	return false
+}
+
+// thermostatInterfaces are the interfaces of the thermostat service of a heater
+var thermostatInterfaces = []fimptype.Interface{{
+	Type:      "in",
+	MsgType:   "cmd.setpoint.set",
+	ValueType: "str_map",
+	Version:   "1",
+}, {
+	Type:      "out",
+	MsgType:   "evt.setpoint.report",
+	ValueType: "str_map",
+	Version:   "1",
+}, {
+	Type:      "in",
+	MsgType:   "cmd.setpoint.get_report",
+	ValueType: "string",
+	Version:   "1",
+}, {
+	Type:      "in",
+	MsgType:   "cmd.mode.set",
+	ValueType: "string",
+	Version:   "1",
+}, {
+	Type:      "in",
+	MsgType:   "cmd.mode.get_report",
+	ValueType: "null",
+	Version:   "1",
+}, {
+	Type:      "out",
+	MsgType:   "evt.mode.report",
+	ValueType: "string",
+	Version:   "1",
+}}
+
+// lockedThermostatInterfaces are the interfaces of the thermostat service of a heater whose setpoint can't be changed
+var lockedThermostatInterfaces = withoutInterface(thermostatInterfaces, "cmd.setpoint.set")
+
+// sensorInterfaces are the interfaces of the sensor_temp service of heaters and rooms
+var sensorInterfaces = []fimptype.Interface{{
+	Type:      "in",
+	MsgType:   "cmd.sensor.get_report",
+	ValueType: "null",
+	Version:   "1",
+}, {
+	Type:      "out",
+	MsgType:   "evt.sensor.report",
+	ValueType: "float",
+	Version:   "1",
+}}
+
+// roomThermostatInterfaces are the interfaces of the thermostat service of a room. The room mode follows the Mill program and can't be set.
+var roomThermostatInterfaces = []fimptype.Interface{{
+	Type:      "in",
+	MsgType:   "cmd.setpoint.set",
+	ValueType: "str_map",
+	Version:   "1",
+}, {
+	Type:      "out",
+	MsgType:   "evt.setpoint.report",
+	ValueType: "str_map",
+	Version:   "1",
+}, {
+	Type:      "in",
+	MsgType:   "cmd.setpoint.get_report",
+	ValueType: "string",
+	Version:   "1",
+}, {
+	Type:      "in",
+	MsgType:   "cmd.mode.get_report",
+	ValueType: "null",
+	Version:   "1",
+}, {
+	Type:      "out",
+	MsgType:   "evt.mode.report",
+	ValueType: "string",
+	Version:   "1",
+}}
+
+// withoutInterface returns a copy of interfaces without the interface for msgType
+func withoutInterface(interfaces []fimptype.Interface, msgType string) []fimptype.Interface {
+	filtered := make([]fimptype.Interface, 0, len(interfaces))
+	for _, intf := range interfaces {
+		if intf.MsgType != msgType {
+			filtered = append(filtered, intf)
+		}
+	}
+	return filtered
+}
+
 type NetworkService struct {
+	configs *Configs
 }
 
-func (ns *NetworkService) SendInclusionReport(nodeId int, DeviceCollection []interface{}) fimptype.ThingInclusionReport {
+func NewNetworkService(configs *Configs) *NetworkService {
+	return &NetworkService{configs: configs}
+}
+
+func (ns *NetworkService) SendInclusionReport(device mill.Device) fimptype.ThingInclusionReport {
 	var deviceId string
 	// var err error
 
@@ -19,50 +125,7 @@ func (ns *NetworkService) SendInclusionReport(nodeId int, DeviceCollection []int
 	var deviceAddr string
 	services := []fimptype.Service{}
 
-	thermostatInterfaces := []fimptype.Interface{{
-		Type:      "in",
-		MsgType:   "cmd.setpoint.set",
-		ValueType: "str_map",
-		Version:   "1",
-	}, {
-		Type:      "out",
-		MsgType:   "evt.setpoint.report",
-		ValueType: "str_map",
-		Version:   "1",
-	}, {
-		Type:      "in",
-		MsgType:   "cmd.setpoint.get_report",
-		ValueType: "string",
-		Version:   "1",
-	}, {
-		Type:      "in",
-		MsgType:   "cmd.mode.set",
-		ValueType: "string",
-		Version:   "1",
-	}, {
-		Type:      "in",
-		MsgType:   "cmd.mode.get_report",
-		ValueType: "null",
-		Version:   "1",
-	}, {
-		Type:      "out",
-		MsgType:   "evt.mode.report",
-		ValueType: "string",
-		Version:   "1",
-	}}
-
-	sensorInterfaces := []fimptype.Interface{{
-		Type:      "in",
-		MsgType:   "cmd.sensor.get_report",
-		ValueType: "null",
-		Version:   "1",
-	}, {
-		Type:      "out",
-		MsgType:   "evt.sensor.report",
-		ValueType: "float",
-		Version:   "1",
-	}}
-
+	minTemp, maxTemp := ns.configs.GetSetpointRange(device)
 	thermostatService := fimptype.Service{
 		Name:    "thermostat",
 		Alias:   "thermostat",
@@ -70,11 +133,17 @@ func (ns *NetworkService) SendInclusionReport(nodeId int, DeviceCollection []int
 		Enabled: true,
 		Groups:  []string{"ch_0"},
 		Props: map[string]interface{}{
-			"sup_modes":     []string{"off", "heat"},
+			"sup_modes":     ThermostatModes,
 			"sup_setpoints": []string{"heat"},
+			"sup_range":     map[string]float64{"min": minTemp, "max": maxTemp},
 		},
 		Interfaces: thermostatInterfaces,
 	}
+	if !device.CanSetTemp() {
+		// the router refuses setpoint changes with setpoint_locked, so they are not advertised
+		delete(thermostatService.Props, "sup_range")
+		thermostatService.Interfaces = lockedThermostatInterfaces
+	}
 
 	tempSensorService := fimptype.Service{
 		Name:    "sensor_temp",
@@ -90,11 +159,9 @@ func (ns *NetworkService) SendInclusionReport(nodeId int, DeviceCollection []int
 		Interfaces:       sensorInterfaces,
 	}
 
-	device := DeviceCollection[nodeId]
-	val := reflect.ValueOf(device)
-	deviceId = strconv.FormatInt(val.FieldByName("DeviceID").Interface().(int64), 10)
+	deviceId = strconv.FormatInt(device.DeviceID, 10)
 	manufacturer = "mill"
-	name = val.FieldByName("DeviceName").Interface().(string)
+	name = device.DeviceName
 	serviceAddress := fmt.Sprintf("%s", deviceId)
 	thermostatService.Address = thermostatService.Address + serviceAddress
 	tempSensorService.Address = tempSensorService.Address + serviceAddress
@@ -125,3 +192,48 @@ func (ns *NetworkService) SendInclusionReport(nodeId int, DeviceCollection []int
 
 	return inclReport
 }
+
+// SendRoomInclusionReport describes a Mill room as a thing with a thermostat service for the comfort (heat), sleep (eco)
+// and away setpoints of the room and a sensor_temp service for the average room temperature
+func (ns *NetworkService) SendRoomInclusionReport(room mill.Room) fimptype.ThingInclusionReport {
+	roomAddr := RoomAddress(room.RoomID)
+	minTemp, maxTemp := ns.configs.GetRoomSetpointRange(room)
+	thermostatService := fimptype.Service{
+		Name:    "thermostat",
+		Alias:   "thermostat",
+		Address: "/rt:dev/rn:mill/ad:1/sv:thermostat/ad:" + roomAddr,
+		Enabled: true,
+		Groups:  []string{"ch_0"},
+		Props: map[string]interface{}{
+			"sup_setpoints": RoomSetpointTypes,
+			"sup_range":     map[string]float64{"min": minTemp, "max": maxTemp},
+		},
+		Interfaces: roomThermostatInterfaces,
+	}
+	tempSensorService := fimptype.Service{
+		Name:    "sensor_temp",
+		Alias:   "Temperature sensor",
+		Address: "/rt:dev/rn:mill/ad:1/sv:sensor_temp/ad:" + roomAddr,
+		Enabled: true,
+		Groups:  []string{"ch_0"},
+		Props: map[string]interface{}{
+			"sup_units": []string{"C"},
+		},
+		Interfaces: sensorInterfaces,
+	}
+
+	return fimptype.ThingInclusionReport{
+		Address:        roomAddr,
+		ProductHash:    "mill_room",
+		CommTechnology: "wifi",
+		ProductName:    room.RoomName,
+		ManufacturerId: "mill",
+		DeviceId:       roomAddr,
+		HwVersion:      "1",
+		SwVersion:      "1",
+		PowerSource:    "ac",
+		WakeUpInterval: "-1",
+		Groups:         []string{"ch_0"},
+		Services:       []fimptype.Service{thermostatService, tempSensorService},
+	}
+}
@@ -0,0 +1,51 @@
+package model
+
+import (
+	"testing"
+
+	"github.com/futurehomeno/fimpgo/fimptype"
+	mill "github.com/thingsplex/mill/millapi"
+)
+
+// thermostatService returns the thermostat service of an inclusion report
+func thermostatService(t *testing.T, report fimptype.ThingInclusionReport) fimptype.Service {
+	t.Helper()
+	for _, service := range report.Services {
+		if service.Name == "thermostat" {
+			return service
+		}
+	}
+	t.Fatal("inclusion report has no thermostat service")
+	return fimptype.Service{}
+}
+
+// hasInterface reports whether service has an interface for msgType
+func hasInterface(service fimptype.Service, msgType string) bool {
+	for _, intf := range service.Interfaces {
+		if intf.MsgType == msgType {
+			return true
+		}
+	}
+	return false
+}
+
+func TestInclusionReportOfLockedDevice(t *testing.T) {
+	ns := NewNetworkService(NewConfigs(newTestWorkDir(t, `{"schema_version": 2}`)))
+
+	unlocked := thermostatService(t, ns.SendInclusionReport(mill.Device{DeviceID: 100, CanChangeTemp: 1}))
+	if !hasInterface(unlocked, "cmd.setpoint.set") || unlocked.Props["sup_range"] == nil {
+		t.Error("device which can change temperature doesn't advertise setpoint changes")
+	}
+
+	locked := thermostatService(t, ns.SendInclusionReport(mill.Device{DeviceID: 200, CanChangeTemp: 0}))
+	if hasInterface(locked, "cmd.setpoint.set") || locked.Props["sup_range"] != nil {
+		t.Error("device which can't change temperature advertises setpoint changes")
+	}
+	if !hasInterface(locked, "evt.setpoint.report") || !hasInterface(locked, "cmd.mode.set") {
+		t.Error("locked device lost its other thermostat interfaces")
+	}
+	// the shared interface list is not modified
+	if !hasInterface(fimptype.Service{Interfaces: thermostatInterfaces}, "cmd.setpoint.set") {
+		t.Error("thermostatInterfaces lost cmd.setpoint.set")
+	}
+}
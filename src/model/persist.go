@@ -0,0 +1,86 @@
+package model
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/thingsplex/mill/utils"
+)
+
+// persistedFilePerm is the mode of persisted files and their backups. config.json holds secrets, even if encrypted.
+const persistedFilePerm = 0600
+
+// backupPath returns the path of the last-good backup of a persisted file
+func backupPath(path string) string {
+	return path + ".bak"
+}
+
+// writeJSONFile marshals v and atomically replaces path with it. The replaced content is kept as the last-good
+// backup, unless it is corrupt itself. With replaceBackup the new content becomes the backup instead, for replaced
+// content which must not be kept, e.g. plaintext secrets.
+func writeJSONFile(path string, v interface{}, replaceBackup bool) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if current, err := ioutil.ReadFile(path); err == nil && json.Valid(current) && !replaceBackup {
+		if err := keepBackup(path); err != nil {
+			log.Warn("<model> Can't keep backup of ", path, ", error: ", err)
+		}
+	}
+	if err := utils.WriteFileAtomic(path, body, persistedFilePerm); err != nil {
+		return err
+	}
+	if replaceBackup {
+		return keepBackup(path)
+	}
+	return nil
+}
+
+// keepBackup makes the current content of path its backup. A hard link is used, so the content is not written
+// twice on every save.
+func keepBackup(path string) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".baktmp")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+	tmp.Close()
+	os.Remove(tmpName)
+	defer os.Remove(tmpName)
+	if err := os.Link(path, tmpName); err != nil {
+		if err := utils.CopyFile(path, tmpName); err != nil {
+			return err
+		}
+	}
+	// files written by older versions may still be world readable
+	if err := os.Chmod(tmpName, persistedFilePerm); err != nil {
+		return err
+	}
+	return os.Rename(tmpName, backupPath(path))
+}
+
+// readJSONFile returns the content of path. If path is missing or is not valid json, the last-good backup
+// is restored and returned instead.
+func readJSONFile(path string) ([]byte, error) {
+	body, err := ioutil.ReadFile(path)
+	if err == nil && json.Valid(body) {
+		return body, nil
+	}
+	if err == nil {
+		err = fmt.Errorf("%s is corrupt", path)
+	}
+	backup, backupErr := ioutil.ReadFile(backupPath(path))
+	if backupErr != nil || !json.Valid(backup) {
+		return nil, err
+	}
+	log.Warn("<model> Can't load ", path, ", error: ", err, ". Restoring last-good backup")
+	if err := utils.WriteFileAtomic(path, backup, persistedFilePerm); err != nil {
+		log.Error("<model> Can't restore ", path, " from backup, error: ", err)
+	}
+	return backup, nil
+}
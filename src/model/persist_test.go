@@ -0,0 +1,102 @@
+package model
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteJSONFileKeepsLastGoodBackup(t *testing.T) {
+	path := filepath.Join(newTestWorkDir(t, ""), "data", "test.json")
+	if err := writeJSONFile(path, map[string]int{"version": 1}, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeJSONFile(path, map[string]int{"version": 2}, false); err != nil {
+		t.Fatal(err)
+	}
+	if backup, _ := ioutil.ReadFile(backupPath(path)); string(backup) != `{"version":1}` {
+		t.Errorf("backup is %q, want the previous content", backup)
+	}
+
+	// corrupt content is not kept as backup
+	if err := ioutil.WriteFile(path, []byte(`{"version":`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeJSONFile(path, map[string]int{"version": 3}, false); err != nil {
+		t.Fatal(err)
+	}
+	if backup, _ := ioutil.ReadFile(backupPath(path)); string(backup) != `{"version":1}` {
+		t.Errorf("backup is %q, want the last valid content", backup)
+	}
+
+	// with replaceBackup the new content is the backup
+	if err := writeJSONFile(path, map[string]int{"version": 4}, true); err != nil {
+		t.Fatal(err)
+	}
+	if backup, _ := ioutil.ReadFile(backupPath(path)); string(backup) != `{"version":4}` {
+		t.Errorf("backup is %q, want the new content", backup)
+	}
+	for _, file := range []string{path, backupPath(path)} {
+		if info, err := os.Stat(file); err != nil || info.Mode().Perm() != persistedFilePerm {
+			t.Errorf("%s: %v, want mode %o", filepath.Base(file), info.Mode().Perm(), persistedFilePerm)
+		}
+	}
+}
+
+func TestReadJSONFileRestoresBackup(t *testing.T) {
+	path := filepath.Join(newTestWorkDir(t, ""), "data", "test.json")
+	if err := ioutil.WriteFile(backupPath(path), []byte(`{"version":1}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range map[string]string{"corrupt": `{"version":`, "empty": ``} {
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		body, err := readJSONFile(path)
+		if err != nil || string(body) != `{"version":1}` {
+			t.Errorf("%s file: got %q, %v, want the backup", name, body, err)
+		}
+		if restored, _ := ioutil.ReadFile(path); string(restored) != `{"version":1}` {
+			t.Errorf("%s file: not restored from the backup, got %q", name, restored)
+		}
+	}
+
+	os.Remove(path)
+	if body, err := readJSONFile(path); err != nil || string(body) != `{"version":1}` {
+		t.Errorf("missing file: got %q, %v, want the backup", body, err)
+	}
+
+	// without a valid backup the error is returned
+	if err := ioutil.WriteFile(path, []byte(`{`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(backupPath(path), []byte(`{`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readJSONFile(path); err == nil {
+		t.Error("corrupt file and backup loaded without error")
+	}
+}
+
+func TestCorruptConfigFallsBackToBackup(t *testing.T) {
+	workDir := newTestWorkDir(t, `{"schema_version": 2, "poll_time_min": "7", "username": "user@example.com"}`)
+	cf := NewConfigs(workDir)
+	if err := cf.LoadFromFile(); err != nil {
+		t.Fatal(err)
+	}
+	if err := cf.SaveToFile(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(cf.path, []byte(`{"schema_version": 2, "poll_`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded := NewConfigs(workDir)
+	if err := reloaded.LoadFromFile(); err != nil {
+		t.Fatal(err)
+	}
+	if reloaded.GetPollTimeMin() != "7" || reloaded.Username != "user@example.com" {
+		t.Errorf("got poll time %q and username %q, want the backup values", reloaded.GetPollTimeMin(), reloaded.Username)
+	}
+}
@@ -0,0 +1,136 @@
+package model
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultPollTimeMin = 5
+	maxPollTimeMin     = 24 * 60
+
+	// after a user command the poller runs every fastPollInterval for fastPollWindow, so the new state shows up quickly
+	fastPollInterval = 15 * time.Second
+	fastPollWindow   = 2 * time.Minute
+	// fastPollDelay gives Mill time to apply a command before the first fast poll
+	fastPollDelay = 5 * time.Second
+
+	// maxPollBackoff caps the poll interval while the Mill API is failing
+	maxPollBackoff = time.Hour
+)
+
+// ParsePollTime validates a poll time in minutes
+func ParsePollTime(pollTimeMin string) (int, error) {
+	minutes, err := strconv.Atoi(pollTimeMin)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a number or contains illegal symbols", pollTimeMin)
+	}
+	if minutes < 1 || minutes > maxPollTimeMin {
+		return 0, fmt.Errorf("poll time must be between 1 and %d minutes, got %d", maxPollTimeMin, minutes)
+	}
+	return minutes, nil
+}
+
+// PollScheduler decides when the poller fetches devices from Mill. The interval is read from Configs on every
+// wait, so a new poll time applies without a restart. PollScheduler is safe for concurrent use.
+type PollScheduler struct {
+	mu        sync.Mutex
+	configs   *Configs
+	wakeup    chan struct{}
+	lastPoll  time.Time
+	fastUntil time.Time
+	failures  int
+}
+
+func NewPollScheduler(configs *Configs) *PollScheduler {
+	return &PollScheduler{configs: configs, wakeup: make(chan struct{}, 1)}
+}
+
+// Interval returns the current poll interval, taking fast polling and failure backoff into account
+func (ps *PollScheduler) Interval() time.Duration {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return ps.interval(time.Now())
+}
+
+func (ps *PollScheduler) interval(now time.Time) time.Duration {
+	interval := ps.configs.GetPollInterval()
+	if ps.failures > 0 {
+		for i := 0; i < ps.failures && interval < maxPollBackoff; i++ {
+			interval *= 2
+		}
+		if interval > maxPollBackoff {
+			interval = maxPollBackoff
+		}
+		return interval
+	}
+	if now.Before(ps.fastUntil) && fastPollInterval < interval {
+		return fastPollInterval
+	}
+	return interval
+}
+
+// Wait blocks until the next poll is due. It returns false if ctx is done first.
+func (ps *PollScheduler) Wait(ctx context.Context) bool {
+	for {
+		ps.mu.Lock()
+		now := time.Now()
+		delay := ps.lastPoll.Add(ps.interval(now)).Sub(now)
+		ps.mu.Unlock()
+		if delay <= 0 {
+			break
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return false
+		case <-ps.wakeup:
+			// interval changed, compute the delay again
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+	ps.mu.Lock()
+	ps.lastPoll = time.Now()
+	ps.mu.Unlock()
+	return ctx.Err() == nil
+}
+
+// Reschedule makes a waiting poller pick up a changed poll time
+func (ps *PollScheduler) Reschedule() {
+	select {
+	case ps.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+// Boost polls fastPollDelay from now, and then faster than usual for a short window. Used after user commands.
+func (ps *PollScheduler) Boost() {
+	ps.mu.Lock()
+	now := time.Now()
+	ps.fastUntil = now.Add(fastPollWindow)
+	if next := now.Add(fastPollDelay); next.Before(ps.lastPoll.Add(ps.interval(now))) {
+		// make the next poll due at next
+		ps.lastPoll = next.Add(-ps.interval(now))
+	}
+	ps.mu.Unlock()
+	ps.Reschedule()
+}
+
+// Success resets the failure backoff
+func (ps *PollScheduler) Success() {
+	ps.mu.Lock()
+	ps.failures = 0
+	ps.mu.Unlock()
+}
+
+// Failure doubles the poll interval, up to maxPollBackoff, until the next Success
+func (ps *PollScheduler) Failure() {
+	ps.mu.Lock()
+	ps.failures++
+	ps.mu.Unlock()
+}
@@ -0,0 +1,47 @@
+package model
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// ReportFilter decides whether a periodic report has to be published. A report goes out when the value
+// changed by at least a delta since the last published report, or when the heartbeat interval has passed.
+// ReportFilter is safe for concurrent use.
+type ReportFilter struct {
+	mu      sync.Mutex
+	configs *Configs
+	last    map[reportKey]publishedReport
+}
+
+type reportKey struct {
+	address string
+	service string
+}
+
+type publishedReport struct {
+	value float64
+	at    time.Time
+}
+
+func NewReportFilter(configs *Configs) *ReportFilter {
+	return &ReportFilter{configs: configs, last: make(map[reportKey]publishedReport)}
+}
+
+// ShouldReport reports whether value has to be published for the service on the device address, and if so
+// records it as published. A zero delta publishes any change.
+func (rf *ReportFilter) ShouldReport(address, service string, value, delta float64) bool {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	key := reportKey{address: address, service: service}
+	now := time.Now()
+	if last, ok := rf.last[key]; ok && now.Sub(last.at) < rf.configs.GetReportHeartbeat() {
+		change := math.Abs(value - last.value)
+		if change == 0 || change < delta {
+			return false
+		}
+	}
+	rf.last[key] = publishedReport{value: value, at: now}
+	return true
+}
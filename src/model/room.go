@@ -0,0 +1,77 @@
+package model
+
+import (
+	"strconv"
+	"strings"
+
+	mill "github.com/thingsplex/mill/millapi"
+)
+
+// roomAddressPrefix tells room things apart from heaters, which are addressed by their Mill device id
+const roomAddressPrefix = "room-"
+
+// FIMP setpoint types of a room thermostat and the Mill room temperature each one maps to
+const (
+	RoomSetpointComfort = "heat"
+	RoomSetpointSleep   = "eco"
+	RoomSetpointAway    = "away"
+)
+
+// RoomSetpointTypes lists the setpoint types of a room thermostat
+var RoomSetpointTypes = []string{RoomSetpointComfort, RoomSetpointSleep, RoomSetpointAway}
+
+// roomModes maps Mill room modes to FIMP thermostat modes
+var roomModes = map[int]string{
+	mill.ModeProgram: RoomSetpointComfort,
+	mill.ModeComfort: RoomSetpointComfort,
+	mill.ModeSleep:   RoomSetpointSleep,
+	mill.ModeAway:    RoomSetpointAway,
+	mill.ModeOff:     "off",
+}
+
+// RoomAddress returns the FIMP thing and service address of a room
+func RoomAddress(roomID int64) string {
+	return roomAddressPrefix + strconv.FormatInt(roomID, 10)
+}
+
+// ParseRoomAddress returns the room id of a room address. It returns false for anything else, e.g. device addresses.
+func ParseRoomAddress(addr string) (int64, bool) {
+	if !strings.HasPrefix(addr, roomAddressPrefix) {
+		return 0, false
+	}
+	roomID, err := strconv.ParseInt(strings.TrimPrefix(addr, roomAddressPrefix), 10, 64)
+	return roomID, err == nil
+}
+
+// RoomSetpoints returns the room temperatures in C by FIMP setpoint type
+func RoomSetpoints(room mill.Room) map[string]float64 {
+	return map[string]float64{
+		RoomSetpointComfort: float64(room.ComfortTemp),
+		RoomSetpointSleep:   float64(room.SleepTemp),
+		RoomSetpointAway:    float64(room.AwayTemp),
+	}
+}
+
+// WithRoomSetpoint returns the comfort, sleep and away temperatures of room, with the one of setpointType replaced by temp
+func WithRoomSetpoint(room mill.Room, setpointType string, temp int) (comfortTemp, sleepTemp, awayTemp int, ok bool) {
+	comfortTemp, sleepTemp, awayTemp = room.ComfortTemp, room.SleepTemp, room.AwayTemp
+	switch setpointType {
+	case RoomSetpointComfort:
+		comfortTemp = temp
+	case RoomSetpointSleep:
+		sleepTemp = temp
+	case RoomSetpointAway:
+		awayTemp = temp
+	default:
+		return 0, 0, 0, false
+	}
+	return comfortTemp, sleepTemp, awayTemp, true
+}
+
+// RoomMode returns the FIMP thermostat mode of the current Mill mode of room
+func RoomMode(room mill.Room) string {
+	if mode, ok := roomModes[room.CurrentMode]; ok {
+		return mode
+	}
+	return RoomSetpointComfort
+}
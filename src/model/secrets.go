@@ -0,0 +1,104 @@
+package model
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/thingsplex/mill/utils"
+)
+
+// encryptedPrefix marks an encrypted value in config.json. Values without it are plaintext from older versions
+// or hand edited files, and are encrypted on the next save.
+const encryptedPrefix = "enc:v1:"
+
+// RedactedValue replaces secrets in outbound config reports and logs
+const RedactedValue = "******"
+
+const (
+	secretKeyFileName = "secret.key"
+	secretKeyFileSize = 32
+	secretKeyContext  = "thingsplex-mill config secrets v1"
+)
+
+var ErrSecretDecrypt = errors.New("can't decrypt secret")
+
+// Secrets encrypts credentials and tokens stored in config.json with AES-GCM.
+// The key is derived from a random key file which never leaves the hub.
+type Secrets struct {
+	aead cipher.AEAD
+}
+
+// NewSecrets loads the key file, creating it on first use
+func NewSecrets(keyFile string) (*Secrets, error) {
+	keyMaterial, err := ioutil.ReadFile(keyFile)
+	if os.IsNotExist(err) {
+		keyMaterial = make([]byte, secretKeyFileSize)
+		if _, err := io.ReadFull(rand.Reader, keyMaterial); err != nil {
+			return nil, err
+		}
+		if err := utils.WriteFileAtomic(keyFile, keyMaterial, 0600); err != nil {
+			return nil, fmt.Errorf("can't create key file: %w", err)
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	if len(keyMaterial) < secretKeyFileSize {
+		return nil, fmt.Errorf("key file %s is too short", keyFile)
+	}
+	mac := hmac.New(sha256.New, keyMaterial)
+	mac.Write([]byte(secretKeyContext))
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Secrets{aead: aead}, nil
+}
+
+// Encrypt returns the encrypted form of plain. Empty and already encrypted values are returned as they are.
+func (s *Secrets) Encrypt(plain string) (string, error) {
+	if plain == "" || IsEncrypted(plain) {
+		return plain, nil
+	}
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	sealed := s.aead.Seal(nonce, nonce, []byte(plain), nil)
+	return encryptedPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt returns the plaintext of an encrypted value. Plaintext values are returned as they are.
+func (s *Secrets) Decrypt(value string) (string, error) {
+	if !IsEncrypted(value) {
+		return value, nil
+	}
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, encryptedPrefix))
+	if err != nil || len(sealed) < s.aead.NonceSize() {
+		return "", ErrSecretDecrypt
+	}
+	nonce, ciphertext := sealed[:s.aead.NonceSize()], sealed[s.aead.NonceSize():]
+	plain, err := s.aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return "", ErrSecretDecrypt
+	}
+	return string(plain), nil
+}
+
+// IsEncrypted reports whether value was produced by Encrypt
+func IsEncrypted(value string) bool {
+	return strings.HasPrefix(value, encryptedPrefix)
+}
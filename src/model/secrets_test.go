@@ -0,0 +1,71 @@
+package model
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSecretsRoundTrip(t *testing.T) {
+	keyFile := filepath.Join(newTestWorkDir(t, ""), "data", secretKeyFileName)
+	secrets, err := NewSecrets(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(keyFile); err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("key file not created with mode 0600: %v", err)
+	}
+
+	encrypted, err := secrets.Encrypt("hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsEncrypted(encrypted) || encrypted == "hunter2" {
+		t.Fatalf("got %q, want an encrypted value", encrypted)
+	}
+	if again, _ := secrets.Encrypt(encrypted); again != encrypted {
+		t.Error("encrypted value encrypted twice")
+	}
+	if other, _ := secrets.Encrypt("hunter2"); other == encrypted {
+		t.Error("encryption is not randomized")
+	}
+
+	// a second instance reads the same key file
+	reloaded, err := NewSecrets(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plain, err := reloaded.Decrypt(encrypted); err != nil || plain != "hunter2" {
+		t.Errorf("got %q, %v, want hunter2", plain, err)
+	}
+	if plain, err := reloaded.Decrypt("plaintext"); err != nil || plain != "plaintext" {
+		t.Errorf("plaintext value changed to %q, %v", plain, err)
+	}
+	if empty, _ := reloaded.Encrypt(""); empty != "" {
+		t.Errorf("empty value encrypted to %q", empty)
+	}
+}
+
+func TestSecretsRejectForeignValues(t *testing.T) {
+	workDir := newTestWorkDir(t, "")
+	secrets, err := NewSecrets(filepath.Join(workDir, "data", "a.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := NewSecrets(filepath.Join(workDir, "data", "b.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted, err := secrets.Encrypt("hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, value := range []string{encrypted[:len(encrypted)-4], encryptedPrefix + "not base64", encryptedPrefix} {
+		if _, err := secrets.Decrypt(value); err != ErrSecretDecrypt {
+			t.Errorf("Decrypt(%q) = %v, want ErrSecretDecrypt", value, err)
+		}
+	}
+	if _, err := other.Decrypt(encrypted); err != ErrSecretDecrypt {
+		t.Errorf("value decrypted with another key file: %v", err)
+	}
+}
@@ -3,17 +3,19 @@ package model
 import (
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"os"
 	"path/filepath"
-	"reflect"
 	"strconv"
+	"sync"
 	"time"
 
 	log "github.com/sirupsen/logrus"
+	mill "github.com/thingsplex/mill/millapi"
 	"github.com/thingsplex/mill/utils"
 )
 
+// States is the adapter state persisted in state.json. Homes, rooms and devices from the last Mill sync
+// are kept in a typed store which is safe for concurrent use.
 type States struct {
 	path         string
 	LogFile      string `json:"log_file"`
@@ -23,14 +25,43 @@ type States struct {
 	ConfiguredAt string `json:"configuret_at"`
 	ConfiguredBy string `json:"configures_by"`
 
-	HomeCollection              []interface{}
-	RoomCollection              []interface{}
-	DeviceCollection            []interface{}
-	IndependentDeviceCollection []interface{}
+	saveMu             sync.Mutex   // serializes SaveToFile, so concurrent saves don't interleave their writes
+	mu                 sync.RWMutex // guards the fields above and the store below
+	homes              map[int64]mill.Home
+	rooms              map[int64]mill.Room
+	devices            map[int64]mill.Device
+	independentDevices map[int64]bool  // ids of devices not assigned to a room
+	roomHomes          map[int64]int64 // home id by room id
+	deviceHomes        map[int64]int64 // home id by device id
+	deviceRooms        map[int64]int64 // room id by device id, for devices assigned to a room
+	homeIDs            []int64         // ids in the order Mill returned them
+	roomIDs            []int64
+	deviceIDs          []int64
+	updatedAt          time.Time // when the homes, rooms and devices were fetched from Mill
+}
+
+// stateFile is the on-disk layout of States
+type stateFile struct {
+	SchemaVersion int       `json:"schema_version"`
+	LogFile       string    `json:"log_file"`
+	LogLevel      string    `json:"log_level"`
+	LogFormat     string    `json:"log_format"`
+	ConfiguredAt  string    `json:"configuret_at"`
+	ConfiguredBy  string    `json:"configures_by"`
+	UpdatedAt     time.Time `json:"updated_at"`
+
+	HomeCollection              []mill.Home
+	RoomCollection              []mill.Room
+	DeviceCollection            []mill.Device
+	IndependentDeviceCollection []mill.Device
+	RoomHomes                   map[int64]int64 `json:"room_homes"`
+	DeviceHomes                 map[int64]int64 `json:"device_homes"`
+	DeviceRooms                 map[int64]int64 `json:"device_rooms"`
 }
 
 func NewStates(workDir string) *States {
 	state := &States{WorkDir: workDir}
+	state.Clear()
 	state.path = filepath.Join(workDir, "data", "state.json")
 	if !utils.FileExists(state.path) {
 		log.Info("State file doesn't exist.Loading default state")
@@ -45,26 +76,71 @@ func NewStates(workDir string) *States {
 }
 
 func (st *States) LoadFromFile() error {
-	stateFileBody, err := ioutil.ReadFile(st.path)
+	stateFileBody, err := readJSONFile(st.path)
+	if err != nil {
+		return err
+	}
+	stateFileBody, err = migrateFile(st.path, stateFileBody, stateMigrations, StateSchemaVersion, nil)
 	if err != nil {
 		return err
 	}
-	err = json.Unmarshal(stateFileBody, st)
+	file := stateFile{}
+	err = json.Unmarshal(stateFileBody, &file)
 	if err != nil {
 		return err
 	}
+	st.mu.Lock()
+	st.LogFile, st.LogLevel, st.LogFormat = file.LogFile, file.LogLevel, file.LogFormat
+	st.ConfiguredAt, st.ConfiguredBy = file.ConfiguredAt, file.ConfiguredBy
+	st.clear()
+	for _, home := range file.HomeCollection {
+		st.addHome(home)
+	}
+	for _, room := range file.RoomCollection {
+		st.addRoom(file.RoomHomes[room.RoomID], room)
+	}
+	independent := make(map[int64]bool)
+	for _, device := range file.IndependentDeviceCollection {
+		independent[device.DeviceID] = true
+	}
+	// DeviceCollection also holds the independent devices
+	for _, list := range [][]mill.Device{file.DeviceCollection, file.IndependentDeviceCollection} {
+		for _, device := range list {
+			st.addDevice(file.DeviceHomes[device.DeviceID], file.DeviceRooms[device.DeviceID], device, independent[device.DeviceID])
+		}
+	}
+	st.updatedAt = file.UpdatedAt
+	st.mu.Unlock()
 	return nil
 }
 
+// SaveToFile writes a snapshot of the states to state.json. It is called by the poller and the router,
+// so saves are serialized and the file is written outside mu.
 func (st *States) SaveToFile() error {
+	st.saveMu.Lock()
+	defer st.saveMu.Unlock()
+	st.mu.Lock()
 	st.ConfiguredBy = "auto"
 	st.ConfiguredAt = time.Now().Format(time.RFC3339)
-	bpayload, err := json.Marshal(st)
-	err = ioutil.WriteFile(st.path, bpayload, 0664)
-	if err != nil {
-		return err
+	file := stateFile{
+		SchemaVersion:               StateSchemaVersion,
+		LogFile:                     st.LogFile,
+		LogLevel:                    st.LogLevel,
+		LogFormat:                   st.LogFormat,
+		ConfiguredAt:                st.ConfiguredAt,
+		ConfiguredBy:                st.ConfiguredBy,
+		UpdatedAt:                   st.updatedAt,
+		HomeCollection:              st.homeList(),
+		RoomCollection:              st.roomList(),
+		DeviceCollection:            st.deviceList(),
+		IndependentDeviceCollection: st.independentDeviceList(),
+		// the maps are replaced, never modified, by Update and Clear, so they can be marshaled after unlocking
+		RoomHomes:   st.roomHomes,
+		DeviceHomes: st.deviceHomes,
+		DeviceRooms: st.deviceRooms,
 	}
-	return err
+	st.mu.Unlock()
+	return writeJSONFile(st.path, file, false)
 }
 
 func (st *States) GetDataDir() string {
@@ -97,26 +173,269 @@ type StateReport struct {
 	AppState AppStates `json:"app_state"`
 }
 
-func (st *States) FindDeviceFromDeviceID(addr string) (index int, err error) {
-	// cf.LoadFromFile()
-
-	for i := 0; i < len(st.DeviceCollection); i++ {
-		val := reflect.ValueOf(st.DeviceCollection[i])
-		deviceId := strconv.FormatInt(val.FieldByName("DeviceID").Interface().(int64), 10)
-		if deviceId == addr {
-			index = i
-			return index, nil
+// Update replaces the stored homes, rooms and devices with a snapshot from Mill. Homes which could not be fetched
+// completely keep their previously stored rooms and devices, so a failed request doesn't make devices disappear.
+func (st *States) Update(inv *mill.Inventory) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	prev := storeSnapshot{st.rooms, st.devices, st.independentDevices, st.roomHomes, st.deviceHomes, st.deviceRooms, st.roomIDs, st.deviceIDs}
+	st.clear()
+	for i := range inv.Homes {
+		home := &inv.Homes[i]
+		homeID := home.Home.HomeID
+		st.addHome(home.Home)
+		for j := range home.Rooms {
+			st.addRoom(homeID, home.Rooms[j].Room)
+			for _, device := range home.Rooms[j].Devices {
+				st.addDevice(homeID, home.Rooms[j].Room.RoomID, device, false)
+			}
+		}
+		for _, device := range home.IndependentDevices {
+			st.addDevice(homeID, 0, device, true)
+		}
+		if home.Err() == nil {
+			continue
 		}
+		for _, roomID := range prev.roomIDs {
+			if _, ok := st.rooms[roomID]; !ok && prev.roomHomes[roomID] == homeID {
+				st.addRoom(homeID, prev.rooms[roomID])
+			}
+		}
+		for _, deviceID := range prev.deviceIDs {
+			if _, ok := st.devices[deviceID]; !ok && prev.deviceHomes[deviceID] == homeID {
+				st.addDevice(homeID, prev.deviceRooms[deviceID], prev.devices[deviceID], prev.independentDevices[deviceID])
+			}
+		}
+	}
+	st.updatedAt = time.Now()
+}
+
+// storeSnapshot keeps the previous maps during Update. clear replaces the maps instead of emptying them,
+// so they stay intact.
+type storeSnapshot struct {
+	rooms              map[int64]mill.Room
+	devices            map[int64]mill.Device
+	independentDevices map[int64]bool
+	roomHomes          map[int64]int64
+	deviceHomes        map[int64]int64
+	deviceRooms        map[int64]int64
+	roomIDs            []int64
+	deviceIDs          []int64
+}
+
+// UpdatedAt returns when the stored homes, rooms and devices were fetched from Mill, or the zero time if never
+func (st *States) UpdatedAt() time.Time {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+	return st.updatedAt
+}
+
+// IsStale reports whether the stored homes, rooms and devices are older than maxAge
+func (st *States) IsStale(maxAge time.Duration) bool {
+	return time.Since(st.UpdatedAt()) > maxAge
+}
+
+func (st *States) addHome(home mill.Home) {
+	if _, ok := st.homes[home.HomeID]; !ok {
+		st.homeIDs = append(st.homeIDs, home.HomeID)
+	}
+	st.homes[home.HomeID] = home
+}
+
+func (st *States) addRoom(homeID int64, room mill.Room) {
+	if _, ok := st.rooms[room.RoomID]; !ok {
+		st.roomIDs = append(st.roomIDs, room.RoomID)
+	}
+	st.rooms[room.RoomID] = room
+	st.roomHomes[room.RoomID] = homeID
+}
+
+// addDevice stores a device. roomID is 0 for independent devices.
+func (st *States) addDevice(homeID, roomID int64, device mill.Device, independent bool) {
+	if _, ok := st.devices[device.DeviceID]; !ok {
+		st.deviceIDs = append(st.deviceIDs, device.DeviceID)
+	}
+	st.devices[device.DeviceID] = device
+	st.deviceHomes[device.DeviceID] = homeID
+	if roomID != 0 {
+		st.deviceRooms[device.DeviceID] = roomID
+	}
+	if independent {
+		st.independentDevices[device.DeviceID] = true
+	}
+}
+
+// Clear removes all homes, rooms and devices
+func (st *States) Clear() {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.clear()
+}
+
+func (st *States) clear() {
+	st.homes = make(map[int64]mill.Home)
+	st.rooms = make(map[int64]mill.Room)
+	st.devices = make(map[int64]mill.Device)
+	st.independentDevices = make(map[int64]bool)
+	st.roomHomes = make(map[int64]int64)
+	st.deviceHomes = make(map[int64]int64)
+	st.deviceRooms = make(map[int64]int64)
+	st.homeIDs, st.roomIDs, st.deviceIDs = nil, nil, nil
+	st.updatedAt = time.Time{}
+}
+
+// Device returns the device with the given id
+func (st *States) Device(deviceID int64) (mill.Device, bool) {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+	device, ok := st.devices[deviceID]
+	return device, ok
+}
+
+// DeviceByAddress returns the device with the given FIMP address, which is the device id
+func (st *States) DeviceByAddress(addr string) (mill.Device, bool) {
+	deviceID, err := strconv.ParseInt(addr, 10, 64)
+	if err != nil {
+		return mill.Device{}, false
+	}
+	return st.Device(deviceID)
+}
+
+// Room returns the room with the given id
+func (st *States) Room(roomID int64) (mill.Room, bool) {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+	room, ok := st.rooms[roomID]
+	return room, ok
+}
+
+// Home returns the home with the given id
+func (st *States) Home(homeID int64) (mill.Home, bool) {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+	home, ok := st.homes[homeID]
+	return home, ok
+}
+
+// IsIndependent reports whether the device is not assigned to a room
+func (st *States) IsIndependent(deviceID int64) bool {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+	return st.independentDevices[deviceID]
+}
+
+// RoomByAddress returns the room with the given FIMP room address, see RoomAddress
+func (st *States) RoomByAddress(addr string) (mill.Room, bool) {
+	roomID, ok := ParseRoomAddress(addr)
+	if !ok {
+		return mill.Room{}, false
+	}
+	return st.Room(roomID)
+}
+
+// DeviceRoom returns the room the device is assigned to
+func (st *States) DeviceRoom(deviceID int64) (mill.Room, bool) {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+	roomID, ok := st.deviceRooms[deviceID]
+	if !ok {
+		return mill.Room{}, false
+	}
+	room, ok := st.rooms[roomID]
+	return room, ok
+}
+
+// DeviceHome returns the home of the device
+func (st *States) DeviceHome(deviceID int64) (mill.Home, bool) {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+	homeID, ok := st.deviceHomes[deviceID]
+	if !ok {
+		return mill.Home{}, false
+	}
+	home, ok := st.homes[homeID]
+	return home, ok
+}
+
+// EffectiveSetpoint returns the temperature in C the device currently heats to. In order, this is the holiday
+// temperature while its home is in holiday mode, the hold temperature of the device if it has one, and the
+// temperature of the current mode of its room. It returns false if none applies, e.g. when the room is off or
+// follows the weekly program.
+func (st *States) EffectiveSetpoint(device mill.Device) (float64, bool) {
+	if home, ok := st.DeviceHome(device.DeviceID); ok && home.IsHoliday != 0 && home.HolidayTemp != 0 {
+		return float64(home.HolidayTemp), true
 	}
-	for i := 0; i < len(st.IndependentDeviceCollection); i++ {
-		val := reflect.ValueOf(st.IndependentDeviceCollection[i])
-		deviceId := strconv.FormatInt(val.FieldByName("DeviceID").Interface().(int64), 10)
-		if deviceId == addr {
-			index = i
-			return index, nil
+	if device.SetpointTemp != 0 {
+		return device.SetpointTemp, true
+	}
+	if room, ok := st.DeviceRoom(device.DeviceID); ok {
+		return room.ModeTemp(room.CurrentMode)
+	}
+	return 0, false
+}
+
+// Homes returns all homes
+func (st *States) Homes() []mill.Home {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+	return st.homeList()
+}
+
+// homeList must be called with mu held
+func (st *States) homeList() []mill.Home {
+	homes := make([]mill.Home, 0, len(st.homeIDs))
+	for _, id := range st.homeIDs {
+		homes = append(homes, st.homes[id])
+	}
+	return homes
+}
+
+// Rooms returns all rooms
+func (st *States) Rooms() []mill.Room {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+	return st.roomList()
+}
+
+// roomList must be called with mu held
+func (st *States) roomList() []mill.Room {
+	rooms := make([]mill.Room, 0, len(st.roomIDs))
+	for _, id := range st.roomIDs {
+		rooms = append(rooms, st.rooms[id])
+	}
+	return rooms
+}
+
+// Devices returns all devices, including independent devices
+func (st *States) Devices() []mill.Device {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+	return st.deviceList()
+}
+
+// deviceList must be called with mu held
+func (st *States) deviceList() []mill.Device {
+	devices := make([]mill.Device, 0, len(st.deviceIDs))
+	for _, id := range st.deviceIDs {
+		devices = append(devices, st.devices[id])
+	}
+	return devices
+}
+
+// IndependentDevices returns the devices which are not assigned to a room
+func (st *States) IndependentDevices() []mill.Device {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+	return st.independentDeviceList()
+}
+
+// independentDeviceList must be called with mu held
+func (st *States) independentDeviceList() []mill.Device {
+	devices := make([]mill.Device, 0, len(st.independentDevices))
+	for _, id := range st.deviceIDs {
+		if st.independentDevices[id] {
+			devices = append(devices, st.devices[id])
 		}
 	}
-	index = 9999 // using err did not work
-	log.Debug(err)
-	return index, err
+	return devices
 }
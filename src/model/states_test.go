@@ -0,0 +1,144 @@
+package model
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	mill "github.com/thingsplex/mill/millapi"
+)
+
+// writeTestStateFile writes data/state.json to workDir
+func writeTestStateFile(t *testing.T, workDir, content string) string {
+	t.Helper()
+	path := filepath.Join(workDir, "data", "state.json")
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// newTestStates returns states with one home, one room with a heater and one independent heater
+func newTestStates(t *testing.T, home mill.Home, room mill.Room) *States {
+	t.Helper()
+	workDir := newTestWorkDir(t, "")
+	writeTestStateFile(t, workDir, `{"schema_version": 1}`)
+	st := NewStates(workDir)
+	st.Update(&mill.Inventory{Homes: []mill.HomeInventory{{
+		Home:               home,
+		Rooms:              []mill.RoomInventory{{Room: room, Devices: []mill.Device{{DeviceID: 100}}}},
+		IndependentDevices: []mill.Device{{DeviceID: 200, SetpointTemp: 19.5}},
+	}}})
+	return st
+}
+
+func TestStatesSaveAndLoad(t *testing.T) {
+	st := newTestStates(t, mill.Home{HomeID: 1}, mill.Room{RoomID: 10, ComfortTemp: 21})
+	if err := st.SaveToFile(); err != nil {
+		t.Fatal(err)
+	}
+	reloaded := NewStates(st.WorkDir)
+	if err := reloaded.LoadFromFile(); err != nil {
+		t.Fatal(err)
+	}
+	if room, ok := reloaded.DeviceRoom(100); !ok || room.RoomID != 10 {
+		t.Errorf("device room %+v, %v, want room 10", room, ok)
+	}
+	if !reloaded.IsIndependent(200) {
+		t.Error("independent device not restored")
+	}
+	if reloaded.UpdatedAt().IsZero() {
+		t.Error("update time not restored")
+	}
+}
+
+// TestConcurrentStateSaves saves from several goroutines while the store is updated, like the poller and
+// the router do. Run with -race.
+func TestConcurrentStateSaves(t *testing.T) {
+	st := newTestStates(t, mill.Home{HomeID: 1}, mill.Room{RoomID: 10})
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				if err := st.SaveToFile(); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for j := 0; j < 10; j++ {
+			st.Update(&mill.Inventory{Homes: []mill.HomeInventory{{Home: mill.Home{HomeID: 1}}}})
+		}
+	}()
+	wg.Wait()
+
+	reloaded := NewStates(st.WorkDir)
+	if err := reloaded.LoadFromFile(); err != nil {
+		t.Fatal("saved state can't be loaded: ", err)
+	}
+}
+
+func TestUpdateKeepsDevicesOfFailedHomes(t *testing.T) {
+	home := mill.Home{HomeID: 1}
+	st := newTestStates(t, home, mill.Room{RoomID: 10})
+
+	// the room list of home 1 failed, so its rooms and devices stay
+	st.Update(&mill.Inventory{Homes: []mill.HomeInventory{{Home: home, RoomsErr: errors.New("failed")}}})
+	if _, ok := st.Device(100); !ok {
+		t.Error("room device dropped after a failed room list")
+	}
+	if _, ok := st.Room(10); !ok {
+		t.Error("room dropped after a failed room list")
+	}
+
+	// a complete snapshot drops them
+	st.Update(&mill.Inventory{Homes: []mill.HomeInventory{{Home: home}}})
+	if len(st.Devices()) != 0 || len(st.Rooms()) != 0 {
+		t.Errorf("got %d devices and %d rooms, want none", len(st.Devices()), len(st.Rooms()))
+	}
+}
+
+func TestEffectiveSetpoint(t *testing.T) {
+	room := mill.Room{RoomID: 10, CurrentMode: mill.ModeComfort, ComfortTemp: 21, SleepTemp: 18, AwayTemp: 15}
+	holidayHome := mill.Home{HomeID: 1, IsHoliday: 1, HolidayTemp: 10}
+	offRoom := room
+	offRoom.CurrentMode = mill.ModeOff
+	sleepRoom := room
+	sleepRoom.CurrentMode = mill.ModeSleep
+	programRoom := room
+	programRoom.CurrentMode = mill.ModeProgram
+	tests := []struct {
+		name   string
+		home   mill.Home
+		room   mill.Room
+		device mill.Device
+		want   float64
+		wantOk bool
+	}{
+		{"room comfort", mill.Home{HomeID: 1}, room, mill.Device{DeviceID: 100}, 21, true},
+		{"room sleep", mill.Home{HomeID: 1}, sleepRoom, mill.Device{DeviceID: 100}, 18, true},
+		{"room off", mill.Home{HomeID: 1}, offRoom, mill.Device{DeviceID: 100}, 0, false},
+		// the active program period is unknown, so no comfort temperature is guessed
+		{"room program", mill.Home{HomeID: 1}, programRoom, mill.Device{DeviceID: 100}, 0, false},
+		{"device hold in program room", mill.Home{HomeID: 1}, programRoom, mill.Device{DeviceID: 100, SetpointTemp: 23.5}, 23.5, true},
+		{"device hold", mill.Home{HomeID: 1}, room, mill.Device{DeviceID: 100, SetpointTemp: 23.5}, 23.5, true},
+		{"independent", mill.Home{HomeID: 1}, room, mill.Device{DeviceID: 200, SetpointTemp: 19.5}, 19.5, true},
+		{"holiday over room", holidayHome, programRoom, mill.Device{DeviceID: 100}, 10, true},
+		{"holiday over hold", holidayHome, room, mill.Device{DeviceID: 200, SetpointTemp: 19.5}, 10, true},
+		{"unknown device", mill.Home{HomeID: 1}, room, mill.Device{DeviceID: 300}, 0, false},
+	}
+	for _, test := range tests {
+		st := newTestStates(t, test.home, test.room)
+		got, ok := st.EffectiveSetpoint(test.device)
+		if got != test.want || ok != test.wantOk {
+			t.Errorf("%s: got %v, %v, want %v, %v", test.name, got, ok, test.want, test.wantOk)
+		}
+	}
+}
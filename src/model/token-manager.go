@@ -0,0 +1,348 @@
+package model
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	mill "github.com/thingsplex/mill/millapi"
+)
+
+var (
+	ErrNotAuthenticated    = errors.New("not authenticated")
+	ErrRefreshTokenExpired = errors.New("refresh token expired, login required")
+)
+
+const (
+	// tokenRefreshMargin is how long before expireTime the access token is refreshed
+	tokenRefreshMargin = 5 * time.Minute
+	// tokenRetryInterval is how long the background refresh waits after a failed refresh
+	tokenRetryInterval = 1 * time.Minute
+	// tokenCheckInterval is the longest the background loop sleeps between refresh token expiry checks
+	tokenCheckInterval = 1 * time.Hour
+	// expiryNotifyInterval is how often the refresh token expiry notification is repeated
+	expiryNotifyInterval = 24 * time.Hour
+	// defaultRefreshWarnDays is used when Configs.RefreshWarnDays is not set
+	defaultRefreshWarnDays = 5
+
+	AuthErrorRefreshExpiring = "REFRESH_TOKEN_EXPIRING"
+	AuthErrorRefreshExpired  = "REFRESH_TOKEN_EXPIRED"
+)
+
+// TokenManager owns Configs.Auth and is the only writer of it. It hands out valid access tokens, refreshes them before they expire
+// and makes sure concurrent callers share a single refresh request.
+type TokenManager struct {
+	mu        sync.Mutex
+	client    *mill.Client
+	configs   *Configs
+	lifecycle *Lifecycle
+	conn      *ConnectivityMonitor
+	refresh   *refreshCall // in-flight refresh, nil if none
+	wakeup    chan struct{}
+
+	expiryNotifier func(status AuthStatus)
+	lastNotified   time.Time // last time expiryNotifier was called
+	lastNotifyCode string    // error code of the last notification
+}
+
+type refreshCall struct {
+	done chan struct{}
+	err  error
+}
+
+func NewTokenManager(client *mill.Client, configs *Configs, lifecycle *Lifecycle, conn *ConnectivityMonitor) *TokenManager {
+	return &TokenManager{client: client, configs: configs, lifecycle: lifecycle, conn: conn, wakeup: make(chan struct{}, 1)}
+}
+
+// SetExpiryNotifier sets a function which is called when the refresh token is about to expire or has expired.
+// It is called at most once a day. Must be called before Start.
+func (tm *TokenManager) SetExpiryNotifier(notifier func(status AuthStatus)) {
+	tm.expiryNotifier = notifier
+}
+
+// Start refreshes the access token in the background shortly before it expires, until ctx is done.
+// It also checks the refresh token expiry and warns the user before a new login is needed.
+func (tm *TokenManager) Start(ctx context.Context) {
+	go func() {
+		for {
+			tm.checkRefreshExpiry()
+			sleep := tm.untilRefresh()
+			if sleep > tokenCheckInterval {
+				sleep = tokenCheckInterval
+			}
+			timer := time.NewTimer(sleep)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-tm.wakeup:
+				timer.Stop()
+				continue
+			case <-timer.C:
+			}
+			if !tm.HasTokens() || tm.untilRefresh() > 0 {
+				continue
+			}
+			if err := tm.Refresh(ctx); err != nil && !errors.Is(err, ErrRefreshTokenExpired) {
+				log.Error("<tokens> Background refresh failed, error: ", err)
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(tokenRetryInterval):
+				}
+			}
+		}
+	}()
+}
+
+// untilRefresh returns how long the background loop should sleep
+func (tm *TokenManager) untilRefresh() time.Duration {
+	auth := tm.configs.GetAuth()
+	if auth.ExpireTime == 0 || time.Now().After(fromMillis(auth.RefreshExpireTime)) {
+		return tokenCheckInterval
+	}
+	if d := time.Until(fromMillis(auth.ExpireTime).Add(-tokenRefreshMargin)); d > 0 {
+		return d
+	}
+	return 0
+}
+
+// HasTokens reports whether an access token has been issued
+func (tm *TokenManager) HasTokens() bool {
+	return tm.configs.GetAuth().AccessToken != ""
+}
+
+// AccessToken returns a valid access token, refreshing it first if it expires soon
+func (tm *TokenManager) AccessToken(ctx context.Context) (string, error) {
+	auth := tm.configs.GetAuth()
+	if auth.AccessToken == "" {
+		return "", ErrNotAuthenticated
+	}
+	now := time.Now()
+	if now.Add(tokenRefreshMargin).Before(fromMillis(auth.ExpireTime)) {
+		return auth.AccessToken, nil
+	}
+	if err := tm.Refresh(ctx); err != nil {
+		if now.Before(fromMillis(auth.ExpireTime)) {
+			// proactive refresh failed, but the old token is still good for a few minutes
+			log.Warn("<tokens> Can't refresh access token before it expires, error: ", err)
+			return auth.AccessToken, nil
+		}
+		return "", err
+	}
+	return tm.configs.GetAuth().AccessToken, nil
+}
+
+// Refresh gets new tokens from Mill. Concurrent calls share one request.
+func (tm *TokenManager) Refresh(ctx context.Context) error {
+	tm.mu.Lock()
+	if call := tm.refresh; call != nil {
+		tm.mu.Unlock()
+		select {
+		case <-call.done:
+			return call.err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	auth := tm.configs.GetAuth()
+	if auth.RefreshToken == "" {
+		tm.mu.Unlock()
+		return ErrNotAuthenticated
+	}
+	if time.Now().After(fromMillis(auth.RefreshExpireTime)) {
+		tm.mu.Unlock()
+		log.Error("<tokens> 30 day refreshExpireTime has expired. Send cmd.auth.login")
+		tm.lifecycle.SetAuthState(AuthStateNotAuthenticated, "refresh token expired")
+		// no requests can be made until the next login
+		tm.conn.Disconnected("refresh token expired")
+		tm.checkRefreshExpiry()
+		return ErrRefreshTokenExpired
+	}
+	call := &refreshCall{done: make(chan struct{})}
+	tm.refresh = call
+	refreshToken := auth.RefreshToken
+	tm.mu.Unlock()
+
+	log.Debug("<tokens> Refreshing tokens")
+	accessToken, newRefreshToken, expireTime, refreshExpireTime, err := tm.client.RefreshToken(ctx, refreshToken)
+
+	tm.mu.Lock()
+	if err == nil {
+		saveErr := tm.configs.Update(func(cf *Configs) {
+			cf.Auth.AccessToken = accessToken
+			cf.Auth.RefreshToken = newRefreshToken
+			cf.Auth.ExpireTime = expireTime
+			cf.Auth.RefreshExpireTime = refreshExpireTime
+		})
+		if saveErr != nil {
+			log.Error("<tokens> Can't save new tokens, error: ", saveErr)
+		}
+	}
+	tm.refresh = nil
+	tm.mu.Unlock()
+	call.err = err
+	close(call.done)
+
+	switch {
+	case err == nil:
+		log.Info("<tokens> Tokens refreshed")
+		tm.lifecycle.ClearError(AppErrorAuthFailed, AppErrorTokenExpired)
+		tm.lifecycle.SetAuthState(AuthStateAuthenticated, "tokens refreshed")
+	case errors.Is(err, mill.ErrTokenExpired), errors.Is(err, mill.ErrInvalidCredentials):
+		log.Error("<tokens> Refresh token rejected, error: ", err)
+		tm.lifecycle.SetAuthState(AuthStateNotAuthenticated, "refresh token rejected")
+		tm.lifecycle.SetError(AppErrorTokenExpired, "")
+		tm.conn.Disconnected("refresh token rejected")
+	default:
+		log.Error("<tokens> Can't refresh tokens, error: ", err)
+	}
+	tm.notify()
+	return err
+}
+
+// Invalidate marks the access token as expired, e.g. after Mill rejected it. The next AccessToken call refreshes it.
+func (tm *TokenManager) Invalidate() {
+	tm.configs.Modify(func(cf *Configs) {
+		if cf.Auth.AccessToken != "" {
+			cf.Auth.ExpireTime = 1
+		}
+	})
+	tm.notify()
+}
+
+// SetAuthorizationCode stores the authorization code used by the next Login
+func (tm *TokenManager) SetAuthorizationCode(authCode string) {
+	tm.configs.Modify(func(cf *Configs) {
+		cf.Auth.AuthorizationCode = authCode
+	})
+}
+
+// Login exchanges the stored authorization code and the user credentials for new tokens
+func (tm *TokenManager) Login(ctx context.Context, password, username string) error {
+	authCode := tm.configs.GetAuth().AuthorizationCode
+	if authCode == "" {
+		tm.lifecycle.SetError(AppErrorAuthFailed, "")
+		return ErrNotAuthenticated
+	}
+
+	accessToken, refreshToken, expireTime, refreshExpireTime, err := tm.client.GetAccessToken(ctx, authCode, password, username)
+	if err != nil {
+		tm.lifecycle.SetAuthState(AuthStateNotAuthenticated, "login failed: "+err.Error())
+		if code := AppErrorCode(err); code != "" {
+			tm.lifecycle.SetError(code, "")
+		}
+		return err
+	}
+	err = tm.configs.Update(func(cf *Configs) {
+		cf.Auth.AccessToken = accessToken
+		cf.Auth.RefreshToken = refreshToken
+		cf.Auth.ExpireTime = expireTime
+		cf.Auth.RefreshExpireTime = refreshExpireTime
+	})
+	if err != nil {
+		log.Error("<tokens> Can't save new tokens, error: ", err)
+	}
+	tm.lifecycle.SetAuthState(AuthStateAuthenticated, "logged in")
+	tm.lifecycle.ClearError(AppErrorAuthFailed, AppErrorTokenExpired)
+	tm.clearExpiryWarning()
+	tm.notify()
+	return nil
+}
+
+// Clear forgets all tokens, e.g. on logout
+func (tm *TokenManager) Clear() {
+	tm.configs.Modify(func(cf *Configs) {
+		cf.Auth = AuthConfig{}
+	})
+	tm.lifecycle.SetAuthState(AuthStateNotAuthenticated, "tokens cleared")
+	tm.clearExpiryWarning()
+	tm.notify()
+}
+
+// RefreshTokenExpiresIn returns how long the refresh token stays valid. It is negative once the token has expired.
+func (tm *TokenManager) RefreshTokenExpiresIn() time.Duration {
+	return time.Until(fromMillis(tm.configs.GetAuth().RefreshExpireTime))
+}
+
+// checkRefreshExpiry sets the lifecycle last error and notifies the user when a new login is needed soon
+func (tm *TokenManager) checkRefreshExpiry() {
+	if !tm.HasTokens() {
+		return
+	}
+	warnDays := tm.configs.RefreshWarnDays
+	if warnDays <= 0 {
+		warnDays = defaultRefreshWarnDays
+	}
+	remaining := tm.RefreshTokenExpiresIn()
+
+	status := AuthStatus{Status: string(AuthStateAuthenticated)}
+	switch {
+	case remaining <= 0:
+		status.Status = string(AuthStateNotAuthenticated)
+		status.ErrorCode = AuthErrorRefreshExpired
+		status.ErrorText = "Mill login has expired. Log in again in the Mill app settings."
+	case remaining < time.Duration(warnDays)*24*time.Hour:
+		status.ErrorCode = AuthErrorRefreshExpiring
+		status.ErrorText = fmt.Sprintf("Mill login expires in %s. Log in again in the Mill app settings to keep your heaters connected.", formatDays(remaining))
+	default:
+		return
+	}
+	if status.ErrorCode == AuthErrorRefreshExpired {
+		tm.lifecycle.SetError(AppErrorTokenExpired, status.ErrorText)
+	} else {
+		tm.lifecycle.SetError(AppErrorTokenExpiring, status.ErrorText)
+	}
+
+	tm.mu.Lock()
+	notify := status.ErrorCode != tm.lastNotifyCode || time.Since(tm.lastNotified) >= expiryNotifyInterval
+	if notify {
+		tm.lastNotified = time.Now()
+		tm.lastNotifyCode = status.ErrorCode
+	}
+	tm.mu.Unlock()
+	if notify {
+		log.Warn("<tokens> ", status.ErrorText)
+		if tm.expiryNotifier != nil {
+			tm.expiryNotifier(status)
+		}
+	}
+}
+
+func (tm *TokenManager) clearExpiryWarning() {
+	tm.mu.Lock()
+	warned := tm.lastNotifyCode != ""
+	tm.lastNotified = time.Time{}
+	tm.lastNotifyCode = ""
+	tm.mu.Unlock()
+	if warned {
+		tm.lifecycle.ClearError(AppErrorTokenExpired, AppErrorTokenExpiring)
+	}
+}
+
+func formatDays(d time.Duration) string {
+	days := int(d.Hours() / 24)
+	switch days {
+	case 0:
+		return "less than a day"
+	case 1:
+		return "1 day"
+	default:
+		return fmt.Sprintf("%d days", days)
+	}
+}
+
+// notify wakes up the background loop so it recalculates when to refresh
+func (tm *TokenManager) notify() {
+	select {
+	case tm.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+func fromMillis(millis int64) time.Time {
+	return time.Unix(0, millis*int64(time.Millisecond))
+}
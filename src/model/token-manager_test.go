@@ -0,0 +1,159 @@
+package model
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	mill "github.com/thingsplex/mill/millapi"
+	"github.com/thingsplex/mill/millapi/milltest"
+)
+
+// newTestTokenManager returns a token manager logged in to a fake Mill cloud
+func newTestTokenManager(t *testing.T) (*TokenManager, *Configs, *milltest.Server) {
+	t.Helper()
+	server := milltest.NewServer()
+	t.Cleanup(server.Close)
+	configs := NewConfigs(newTestWorkDir(t, `{"schema_version": 2, "poll_time_min": "5"}`))
+	if err := configs.LoadFromFile(); err != nil {
+		t.Fatal(err)
+	}
+	client := mill.New(mill.WithBaseURL(server.URL + "/"))
+	lifecycle := NewAppLifecycle()
+	tm := NewTokenManager(client, configs, lifecycle, NewConnectivityMonitor(lifecycle))
+	tm.SetAuthorizationCode(milltest.DefaultAuthCode)
+	if err := tm.Login(context.Background(), milltest.DefaultPassword, milltest.DefaultUsername); err != nil {
+		t.Fatal(err)
+	}
+	return tm, configs, server
+}
+
+// TestTokenRefreshWhileConfigsChange runs token refreshes next to the config reads and writes of the router.
+// Run with -race.
+func TestTokenRefreshWhileConfigsChange(t *testing.T) {
+	tm, configs, _ := newTestTokenManager(t)
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			if err := tm.Refresh(ctx); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			configs.Update(func(cf *Configs) {
+				cf.PollTimeMin = "10"
+				cf.Username, cf.Password = "", ""
+			})
+			configs.Modify(func(cf *Configs) {
+				cf.UID = "uid"
+			})
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			configs.Redacted()
+			configs.GetPollInterval()
+			if _, err := tm.AccessToken(ctx); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+	wg.Wait()
+
+	reloaded := NewConfigs(configs.WorkDir)
+	if err := reloaded.LoadFromFile(); err != nil {
+		t.Fatal(err)
+	}
+	if reloaded.GetAuth() != configs.GetAuth() {
+		t.Error("saved tokens differ from the tokens in memory")
+	}
+}
+
+func TestConcurrentAccessTokenSharesRefresh(t *testing.T) {
+	tm, _, server := newTestTokenManager(t)
+	tm.Invalidate()
+	calls := server.Calls(mill.EndpointRefreshToken)
+	// a slow refresh makes sure the callers overlap
+	server.SetDelay(50 * time.Millisecond)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := tm.AccessToken(context.Background()); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if refreshes := server.Calls(mill.EndpointRefreshToken) - calls; refreshes != 1 {
+		t.Errorf("%d refresh requests, want 1", refreshes)
+	}
+}
+
+func TestExpiredAccessTokenIsNotReported(t *testing.T) {
+	tm, _, server := newTestTokenManager(t)
+	var reported []AppError
+	tm.lifecycle.SetErrorNotifier(func(appErr AppError) {
+		reported = append(reported, appErr)
+	})
+
+	// a request with the expired token fails, the token manager refreshes it
+	server.ExpireAccessToken()
+	accessToken, _ := tm.AccessToken(context.Background())
+	_, err := tm.client.GetHomeList(context.Background(), accessToken)
+	if !errors.Is(err, mill.ErrTokenExpired) {
+		t.Fatalf("got %v, want ErrTokenExpired", err)
+	}
+	tm.lifecycle.RecordError(err)
+	tm.lifecycle.RecordError(ErrNotAuthenticated)
+	tm.Invalidate()
+	if _, err := tm.AccessToken(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(reported) != 0 {
+		t.Errorf("recovered token errors were reported: %v", reported)
+	}
+
+	// a rejected refresh needs a new login
+	server.ExpireRefreshToken()
+	tm.Invalidate()
+	if _, err := tm.AccessToken(context.Background()); err == nil {
+		t.Fatal("refresh with an expired refresh token succeeded")
+	}
+	if code := tm.lifecycle.CurrentError().Code; code != AppErrorTokenExpired {
+		t.Errorf("current error %q, want %q", code, AppErrorTokenExpired)
+	}
+}
+
+func TestRejectedRefreshPublishesDisconnect(t *testing.T) {
+	tm, _, server := newTestTokenManager(t)
+	var published []State
+	tm.conn.SetNotifier(func(state State) {
+		published = append(published, state)
+	})
+	tm.conn.Record(mill.EndpointRefreshToken, nil)
+
+	server.ExpireRefreshToken()
+	tm.Invalidate()
+	if _, err := tm.AccessToken(context.Background()); err == nil {
+		t.Fatal("refresh with an expired refresh token succeeded")
+	}
+	if state := tm.lifecycle.ConnectionState(); state != ConnStateDisconnected {
+		t.Errorf("connection state %s, want %s", state, ConnStateDisconnected)
+	}
+	if len(published) != 2 || published[1] != ConnStateDisconnected {
+		t.Errorf("published connection states %v, want the disconnect to be published", published)
+	}
+}
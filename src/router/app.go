@@ -0,0 +1,189 @@
+package router
+
+import (
+	"path/filepath"
+
+	"github.com/futurehomeno/fimpgo"
+	log "github.com/sirupsen/logrus"
+	"github.com/thingsplex/mill/model"
+)
+
+func init() {
+	register(handler{service: model.ServiceName, msgType: "cmd.system.set_poll_time", valueType: fimpgo.VTypeString, handle: (*FromFimpRouter).systemSetPollTime})
+	register(handler{service: model.ServiceName, msgType: "cmd.app.get_manifest", valueType: fimpgo.VTypeString, handle: (*FromFimpRouter).appGetManifest})
+	register(handler{service: model.ServiceName, msgType: "cmd.app.get_state", handle: (*FromFimpRouter).appGetState})
+	register(handler{service: model.ServiceName, msgType: "cmd.app.get_state_history", handle: (*FromFimpRouter).appGetStateHistory})
+	register(handler{service: model.ServiceName, msgType: "cmd.config.get_extended_report", handle: (*FromFimpRouter).configGetExtendedReport})
+	register(handler{service: model.ServiceName, msgType: "cmd.config.extended_set", valueType: fimpgo.VTypeObject, handle: (*FromFimpRouter).configExtendedSet})
+	register(handler{service: model.ServiceName, msgType: "cmd.log.set_level", valueType: fimpgo.VTypeString, handle: (*FromFimpRouter).logSetLevel})
+	register(handler{service: model.ServiceName, msgType: "cmd.system.reconnect", handle: (*FromFimpRouter).systemReconnect})
+	register(handler{service: model.ServiceName, msgType: "cmd.app.factory_reset", handle: (*FromFimpRouter).appFactoryReset})
+}
+
+func (fc *FromFimpRouter) systemSetPollTime(req *request) {
+	pollTimeMin, _ := req.msg.Payload.GetStringValue()
+	if _, err := model.ParsePollTime(pollTimeMin); err != nil {
+		fc.appLifecycle.SetError(model.AppErrorInvalidConfig, "Invalid poll time: "+err.Error())
+		fc.replyError(req.msg, ErrCodeInvalidValue, err.Error())
+		return
+	}
+	fc.appLifecycle.ClearError(model.AppErrorInvalidConfig)
+	fc.configs.Update(func(cf *model.Configs) {
+		cf.PollTimeMin = pollTimeMin
+	})
+	fc.poller.Reschedule()
+	log.Info("Poll time updated to ", pollTimeMin, " minutes")
+}
+
+func (fc *FromFimpRouter) appGetManifest(req *request) {
+	mode, err := req.msg.Payload.GetStringValue()
+	if err != nil {
+		log.Error("Incorrect request format ")
+		return
+	}
+	manifest := model.NewManifest()
+	err = manifest.LoadFromFile(filepath.Join(fc.configs.GetDefaultDir(), "app-manifest.json"))
+	if err != nil {
+		log.Error("Failed to load manifest file .Error :", err.Error())
+		return
+	}
+	// the errors block and the connection state are shown in every mode
+	lastError := fc.appLifecycle.LastError()
+	fc.configs.Modify(func(cf *model.Configs) {
+		cf.ConnectionState = string(fc.appLifecycle.ConnectionState())
+		cf.Errors = lastError
+	})
+	if mode == "manifest_state" {
+		manifest.AppState = *fc.appLifecycle.GetAllStates()
+		manifest.ConfigState = fc.configs.Redacted()
+	}
+	if errConf := manifest.GetAppConfig("errors"); errConf != nil {
+		if lastError == "" {
+			errConf.Hidden = true
+		} else {
+			errConf.Hidden = false
+		}
+	}
+
+	connectButton := manifest.GetButton("connect")
+	disconnectButton := manifest.GetButton("disconnect")
+	if connectButton != nil && disconnectButton != nil {
+		if fc.appLifecycle.ConnectionState() == model.ConnStateConnected {
+			connectButton.Hidden = true
+			disconnectButton.Hidden = false
+		} else {
+			connectButton.Hidden = false
+			disconnectButton.Hidden = true
+		}
+	}
+	if syncButton := manifest.GetButton("sync"); syncButton != nil {
+		if fc.appLifecycle.ConnectionState() == model.ConnStateConnected {
+			syncButton.Hidden = false
+		} else {
+			syncButton.Hidden = false
+		}
+	}
+	pollTimeBlock := manifest.GetUIBlock("poll_time_min")
+	if pollTimeBlock != nil {
+		pollTimeBlock.Hidden = false
+	}
+	settingsBlock := manifest.GetUIBlock("settings")
+	if settingsBlock != nil {
+		settingsBlock.Hidden = false
+	}
+	msg := fimpgo.NewMessage("evt.app.manifest_report", model.ServiceName, fimpgo.VTypeObject, manifest, nil, nil, req.msg.Payload)
+	fc.respond(req.msg, msg)
+}
+
+func (fc *FromFimpRouter) appGetState(req *request) {
+	msg := fimpgo.NewMessage("evt.app.manifest_report", model.ServiceName, fimpgo.VTypeObject, fc.appLifecycle.GetAllStates(), nil, nil, req.msg.Payload)
+	fc.respond(req.msg, msg)
+}
+
+func (fc *FromFimpRouter) appGetStateHistory(req *request) {
+	msg := fimpgo.NewMessage("evt.app.state_history_report", model.ServiceName, fimpgo.VTypeObject, fc.appLifecycle.History(), nil, nil, req.msg.Payload)
+	fc.respond(req.msg, msg)
+}
+
+func (fc *FromFimpRouter) configGetExtendedReport(req *request) {
+	msg := fimpgo.NewMessage("evt.config.extended_report", model.ServiceName, fimpgo.VTypeObject, fc.configs.Redacted(), nil, nil, req.msg.Payload)
+	fc.respond(req.msg, msg)
+}
+
+func (fc *FromFimpRouter) configExtendedSet(req *request) {
+	conf := model.Configs{}
+	err := req.msg.Payload.GetObjectValue(&conf)
+	if err != nil {
+		// TODO: This is an example . Add your logic here or remove
+		log.Error("Can't parse configuration object")
+		fc.appLifecycle.SetError(model.AppErrorInvalidConfig, "Can't parse configuration: "+err.Error())
+		return
+	}
+	pollTimeMin := conf.PollTimeMin
+	opStatus := "ok"
+	if _, err := model.ParsePollTime(pollTimeMin); err != nil {
+		log.Error("Can't set poll time: ", err)
+		fc.appLifecycle.SetError(model.AppErrorInvalidConfig, "Invalid poll time: "+err.Error())
+		opStatus = "error"
+	} else {
+		fc.appLifecycle.ClearError(model.AppErrorInvalidConfig)
+		fc.configs.Update(func(cf *model.Configs) {
+			cf.PollTimeMin = pollTimeMin
+		})
+		fc.poller.Reschedule()
+		log.Info("App reconfigured, new configs: ", fc.configs.Redacted())
+	}
+
+	configReport := model.ConfigReport{
+		OpStatus: opStatus,
+		AppState: *fc.appLifecycle.GetAllStates(),
+	}
+	msg := fimpgo.NewMessage("evt.app.config_report", model.ServiceName, fimpgo.VTypeObject, configReport, nil, nil, req.msg.Payload)
+	fc.respond(req.msg, msg)
+}
+
+func (fc *FromFimpRouter) logSetLevel(req *request) {
+	// Configure log level
+	level, err := req.msg.Payload.GetStringValue()
+	if err != nil {
+		return
+	}
+	logLevel, err := log.ParseLevel(level)
+	if err == nil {
+		log.SetLevel(logLevel)
+		fc.configs.Update(func(cf *model.Configs) {
+			cf.LogLevel = level
+		})
+	}
+	log.Info("Log level updated to = ", logLevel)
+}
+
+func (fc *FromFimpRouter) systemReconnect(req *request) {
+	// This is optional operation.
+	fc.appLifecycle.PublishEvent(model.EventConfigured, "from-fimp-router", nil)
+
+	val := model.ButtonActionResponse{
+		Operation:       "cmd.system.reconnect",
+		OperationStatus: "ok",
+		Next:            "config",
+		ErrorCode:       "",
+		ErrorText:       "",
+	}
+	msg := fimpgo.NewMessage("evt.app.config_action_report", model.ServiceName, fimpgo.VTypeObject, val, nil, nil, req.msg.Payload)
+	fc.respond(req.msg, msg)
+}
+
+func (fc *FromFimpRouter) appFactoryReset(req *request) {
+	val := model.ButtonActionResponse{
+		Operation:       "cmd.app.factory_reset",
+		OperationStatus: "ok",
+		Next:            "config",
+		ErrorCode:       "",
+		ErrorText:       "",
+	}
+	fc.appLifecycle.SetConfigState(model.ConfigStateNotConfigured, "factory reset")
+	fc.appLifecycle.SetAppState(model.AppStateNotConfigured, "factory reset")
+	fc.appLifecycle.SetAuthState(model.AuthStateNotAuthenticated, "factory reset")
+	msg := fimpgo.NewMessage("evt.app.config_action_report", model.ServiceName, fimpgo.VTypeObject, val, nil, nil, req.msg.Payload)
+	fc.respond(req.msg, msg)
+}
@@ -0,0 +1,140 @@
+package router
+
+import (
+	"errors"
+
+	"github.com/futurehomeno/fimpgo"
+	log "github.com/sirupsen/logrus"
+	"github.com/thingsplex/mill/model"
+)
+
+func init() {
+	register(handler{service: model.ServiceName, msgType: "cmd.auth.login", valueType: fimpgo.VTypeObject, handle: (*FromFimpRouter).authLogin})
+	register(handler{service: model.ServiceName, msgType: "cmd.auth.set_tokens", handle: (*FromFimpRouter).authSetTokens})
+	register(handler{service: model.ServiceName, msgType: "cmd.auth.logout", handle: (*FromFimpRouter).authLogout})
+	// hub token from the cloud auth-api, requested by cmd.auth.login
+	register(handler{service: "auth-api", handle: (*FromFimpRouter).authHubToken})
+}
+
+// loginResponseTopic is where the smarthome app waits for the result of a login
+const loginResponseTopic = "pt:j1/mt:rsp/rt:cloud/rn:remote-client/ad:smarthome-app"
+
+func (fc *FromFimpRouter) authLogin(req *request) {
+	newadr, msg, err := fc.configs.GetHubToken(req.msg)
+	if errors.Is(err, model.ErrEncryptedLogin) {
+		fc.replyError(req.msg, ErrCodeInvalidValue, err.Error())
+		return
+	}
+	if err != nil {
+		log.Error("Something went wrong when getting hub token, error: ", err)
+		fc.appLifecycle.SetError(model.AppErrorAuthFailed, "")
+	} else {
+		fc.mqt.Publish(newadr, msg)
+	}
+
+	fc.configs.Modify(func(cf *model.Configs) {
+		cf.UID = req.msg.Payload.UID
+	})
+}
+
+func (fc *FromFimpRouter) authSetTokens(req *request) {
+	username, password := fc.configs.GetCredentials()
+	if err := fc.tokens.Login(fc.ctx, password, username); err != nil {
+		// the token manager sets the error
+		log.Error("Can't get access token, error: ", err)
+	}
+	fc.configs.Update(func(cf *model.Configs) {
+		cf.Username = ""
+		cf.Password = ""
+	})
+	fc.states.SaveToFile()
+	accessToken, _ := fc.tokens.AccessToken(fc.ctx)
+
+	if accessToken != "" {
+		log.Debug("All tokens received and saved.")
+		fc.appLifecycle.PublishEvent(model.EventConfigured, "from-fimp-router", nil)
+		loginval := map[string]interface{}{
+			"errors":  nil,
+			"success": true,
+		}
+		newadr, err := fimpgo.NewAddressFromString(loginResponseTopic)
+		if err != nil {
+			log.Debug("Could not make login response topic")
+		}
+		msg := fimpgo.NewMessage("evt.pd7.response", "vinculum", fimpgo.VTypeObject, loginval, nil, nil, req.msg.Payload)
+		msg.CorrelationID = fc.configs.GetUID()
+		fc.mqt.Publish(newadr, msg)
+	} else {
+		log.Info("Login failed, please try again")
+		loginval := map[string]interface{}{
+			"errors":  "Wrong username or password",
+			"success": false,
+		}
+		newadr, err := fimpgo.NewAddressFromString(loginResponseTopic)
+		if err != nil {
+			log.Debug("Could not make login response topic")
+		}
+		msg := fimpgo.NewMessage("evt.pd7.response", "vinculum", fimpgo.VTypeObject, loginval, nil, nil, req.msg.Payload)
+		msg.CorrelationID = fc.configs.GetUID()
+		fc.mqt.Publish(newadr, msg)
+	}
+
+	msg := fimpgo.NewMessage("evt.auth.status_report", model.ServiceName, fimpgo.VTypeObject, fc.appLifecycle.GetAllStates(), nil, nil, req.msg.Payload)
+	fc.respond(req.msg, msg)
+
+	// Delete previously saved nodes, if there are any for some reason
+	fc.updateStates(accessToken)
+
+	msg = fimpgo.NewMessage("evt.network.get_all_nodes_report", model.ServiceName, fimpgo.VTypeObject, fc.states.Devices(), nil, nil, req.msg.Payload)
+	fc.respond(req.msg, msg)
+
+	fc.sendInclusionReports(nil)
+	fc.configs.SaveToFile()
+	fc.states.SaveToFile()
+}
+
+func (fc *FromFimpRouter) authLogout(req *request) {
+	fc.tokens.Clear()
+	fc.appLifecycle.SetConfigState(model.ConfigStateNotConfigured, "logout")
+	fc.appLifecycle.SetAppState(model.AppStateNotConfigured, "logout")
+	fc.connectivity.Disconnected("logout")
+	fc.sendExclusionReports(req.msg.Payload)
+
+	fc.states.Clear()
+	fc.configs.LoadDefaults()
+	fc.states.LoadDefaults()
+
+	val2 := map[string]interface{}{
+		"errors":  nil,
+		"success": true,
+	}
+	msg := fimpgo.NewMessage("evt.pd7.response", "vinculum", fimpgo.VTypeObject, val2, nil, nil, req.msg.Payload)
+	if err := fc.mqt.RespondToRequest(req.msg.Payload, msg); err != nil {
+		log.Error("Could not respond to wanted request")
+	}
+	log.Info("Logged out and deleted all devices.")
+}
+
+func (fc *FromFimpRouter) authHubToken(req *request) {
+	val, err := req.msg.Payload.GetStrMapValue()
+	if err != nil {
+		log.Error("Wrong msg format")
+		return
+	}
+	hubToken := val["token"]
+	fc.configs.Modify(func(cf *model.Configs) {
+		cf.HubToken = hubToken
+	})
+	authCode, err := fc.client.GetAuthCode(fc.ctx, hubToken)
+	if err != nil {
+		log.Error("Can't get authorization code, error: ", err)
+	}
+	fc.tokens.SetAuthorizationCode(authCode)
+
+	msg := fimpgo.NewMessage("cmd.auth.set_tokens", model.ServiceName, fimpgo.VTypeString, "", nil, nil, req.msg.Payload)
+	newadr, err := fimpgo.NewAddressFromString("pt:j1/mt:cmd/rt:ad/rn:mill/ad:1")
+	if err != nil {
+		log.Debug(err)
+	}
+	fc.mqt.Publish(newadr, msg)
+}
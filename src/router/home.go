@@ -0,0 +1,216 @@
+package router
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/futurehomeno/fimpgo"
+	log "github.com/sirupsen/logrus"
+	mill "github.com/thingsplex/mill/millapi"
+	"github.com/thingsplex/mill/model"
+)
+
+func init() {
+	register(handler{service: model.ServiceName, msgType: "cmd.home.get_report", state: stateCached, handle: (*FromFimpRouter).homeGetReport})
+	register(handler{service: model.ServiceName, msgType: "cmd.home.set_holiday", valueType: fimpgo.VTypeStrMap, requiresAuth: true, state: stateCached, handle: (*FromFimpRouter).homeSetHoliday})
+	register(handler{service: model.ServiceName, msgType: "cmd.home.cancel_holiday", requiresAuth: true, state: stateCached, handle: (*FromFimpRouter).homeCancelHoliday})
+	register(handler{service: model.ServiceName, msgType: "cmd.home.set_mode", valueType: fimpgo.VTypeStrMap, requiresAuth: true, state: stateCached, handle: (*FromFimpRouter).homeSetMode})
+	// Futurehome house mode changes, followed when mode_sync is enabled. vinculum sends many other notifications,
+	// so the handler only gets a token for house mode changes.
+	register(handler{service: "vinculum", msgType: "evt.pd7.notify", handle: (*FromFimpRouter).houseModeNotify})
+}
+
+// pd7Notify is the value of evt.pd7.notify, e.g. {"cmd":"set", "component":"hub", "id":"mode", "param":{"current":"away", "prev":"home"}}
+type pd7Notify struct {
+	Cmd       string `json:"cmd"`
+	Component string `json:"component"`
+	ID        string `json:"id"`
+	Param     struct {
+		Current string `json:"current"`
+		Prev    string `json:"prev"`
+	} `json:"param"`
+}
+
+// targetHomes returns the home with homeID, or all homes if homeID is empty
+func (fc *FromFimpRouter) targetHomes(homeID string) ([]mill.Home, error) {
+	if homeID == "" {
+		return fc.states.Homes(), nil
+	}
+	id, err := strconv.ParseInt(homeID, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("can't find home %s", homeID)
+	}
+	home, ok := fc.states.Home(id)
+	if !ok {
+		return nil, fmt.Errorf("can't find home %s", homeID)
+	}
+	return []mill.Home{home}, nil
+}
+
+// sendHomeReport answers req with the cached state of all homes
+func (fc *FromFimpRouter) sendHomeReport(req *request) {
+	report := []model.HomeReport{}
+	for _, home := range fc.states.Homes() {
+		report = append(report, model.NewHomeReport(home))
+	}
+	msg := fimpgo.NewMessage("evt.home.report", model.ServiceName, fimpgo.VTypeObject, report, nil, nil, req.msg.Payload)
+	fc.respond(req.msg, msg)
+}
+
+// homeCommandDone refreshes the cached homes after a successful home command and reports them
+func (fc *FromFimpRouter) homeCommandDone(req *request) {
+	fc.appLifecycle.RecordAPIResult(nil)
+	fc.updateStates(req.accessToken)
+	fc.poller.Boost()
+	fc.sendHomeReport(req)
+}
+
+func (fc *FromFimpRouter) homeGetReport(req *request) {
+	fc.sendHomeReport(req)
+}
+
+// homeSetHoliday starts holiday mode, val = {"home_id":"123", "start":"2026-12-20", "end":"2026-12-27", "temp":"10"}.
+// A missing home_id applies to all homes, a missing start starts the holiday now.
+func (fc *FromFimpRouter) homeSetHoliday(req *request) {
+	val, _ := req.msg.Payload.GetStrMapValue()
+	homes, err := fc.targetHomes(val["home_id"])
+	if err != nil {
+		fc.replyError(req.msg, ErrCodeUnknownDevice, err.Error())
+		return
+	}
+	start := time.Now()
+	if val["start"] != "" {
+		if start, err = model.ParseHolidayTime(val["start"], false); err != nil {
+			fc.replyError(req.msg, ErrCodeInvalidValue, "start: "+err.Error())
+			return
+		}
+	}
+	end, err := model.ParseHolidayTime(val["end"], true)
+	if err != nil {
+		fc.replyError(req.msg, ErrCodeInvalidValue, "end: "+err.Error())
+		return
+	}
+	if !end.After(start) || !end.After(time.Now()) {
+		fc.replyError(req.msg, ErrCodeInvalidValue, fmt.Sprintf("holiday end %s must be after start %s and in the future", end.Format(time.RFC3339), start.Format(time.RFC3339)))
+		return
+	}
+	temp, err := strconv.ParseFloat(val["temp"], 64)
+	if err != nil {
+		fc.replyError(req.msg, ErrCodeInvalidValue, fmt.Sprintf("temp %q is not a number", val["temp"]))
+		return
+	}
+	if minTemp, maxTemp := fc.configs.GetHolidaySetpointRange(); temp < minTemp || temp > maxTemp {
+		fc.replyError(req.msg, ErrCodeOutOfRange, fmt.Sprintf("holiday temperature %s is outside the allowed range %s-%s C", mill.FormatTemp(temp), mill.FormatTemp(minTemp), mill.FormatTemp(maxTemp)))
+		return
+	}
+	// Mill takes whole degrees for holidays
+	holidayTemp := int(mill.RoundSetpoint(temp, 1))
+
+	for _, home := range homes {
+		if err := fc.client.SetHoliday(fc.ctx, req.accessToken, home.HomeID, start, end, holidayTemp); err != nil {
+			log.Error("Can't start holiday in home ", home.HomeID, ", error: ", err)
+			fc.replyAPIError(req.msg, err)
+			return
+		}
+		log.Infof("Holiday in home %d set from %s to %s at %d C", home.HomeID, start.Format(time.RFC3339), end.Format(time.RFC3339), holidayTemp)
+	}
+	fc.homeCommandDone(req)
+}
+
+// homeCancelHoliday ends holiday mode, val = {"home_id":"123"} or null for all homes
+func (fc *FromFimpRouter) homeCancelHoliday(req *request) {
+	val, _ := req.msg.Payload.GetStrMapValue()
+	homes, err := fc.targetHomes(val["home_id"])
+	if err != nil {
+		fc.replyError(req.msg, ErrCodeUnknownDevice, err.Error())
+		return
+	}
+	for _, home := range homes {
+		if err := fc.client.CancelHoliday(fc.ctx, req.accessToken, home.HomeID); err != nil {
+			log.Error("Can't cancel holiday in home ", home.HomeID, ", error: ", err)
+			fc.replyAPIError(req.msg, err)
+			return
+		}
+		log.Info("Holiday in home ", home.HomeID, " canceled")
+	}
+	fc.homeCommandDone(req)
+}
+
+// homeSetMode forces a home mode, val = {"home_id":"123", "mode":"away", "duration_min":"120"}.
+// A missing home_id applies to all homes. Mode program returns to the weekly program and needs no duration.
+func (fc *FromFimpRouter) homeSetMode(req *request) {
+	val, _ := req.msg.Payload.GetStrMapValue()
+	homes, err := fc.targetHomes(val["home_id"])
+	if err != nil {
+		fc.replyError(req.msg, ErrCodeUnknownDevice, err.Error())
+		return
+	}
+	mode, err := model.ParseHomeMode(val["mode"])
+	if err != nil {
+		fc.replyError(req.msg, ErrCodeInvalidValue, err.Error())
+		return
+	}
+	var duration time.Duration
+	if mode != mill.ModeProgram {
+		minutes, err := strconv.Atoi(val["duration_min"])
+		if err != nil || minutes < 1 {
+			fc.replyError(req.msg, ErrCodeInvalidValue, fmt.Sprintf("duration_min %q must be a whole number of minutes above 0", val["duration_min"]))
+			return
+		}
+		duration = time.Duration(minutes) * time.Minute
+	}
+	if err := fc.setHomeMode(req.accessToken, homes, mode, duration); err != nil {
+		fc.replyAPIError(req.msg, err)
+		return
+	}
+	fc.homeCommandDone(req)
+}
+
+// setHomeMode sets the mode of homes, stopping at the first failure. The caller handles the error.
+func (fc *FromFimpRouter) setHomeMode(accessToken string, homes []mill.Home, mode int, duration time.Duration) error {
+	for _, home := range homes {
+		if err := fc.client.SetHomeMode(fc.ctx, accessToken, home.HomeID, mode, duration); err != nil {
+			log.Error("Can't set mode of home ", home.HomeID, ", error: ", err)
+			return err
+		}
+		log.Info("Home ", home.HomeID, " set to mode ", model.HomeModeName(mode), " for ", duration)
+	}
+	return nil
+}
+
+// houseModeNotify sets the Mill home mode of all homes when the Futurehome house mode changes and mode_sync is enabled
+func (fc *FromFimpRouter) houseModeNotify(req *request) {
+	notify := pd7Notify{}
+	if err := req.msg.Payload.GetObjectValue(&notify); err != nil || notify.Component != "hub" || notify.ID != "mode" || notify.Cmd != "set" {
+		return
+	}
+	if !fc.configs.ModeSync {
+		return
+	}
+	houseMode := notify.Param.Current
+	modeName, ok := fc.configs.GetModeSyncMode(houseMode)
+	if !ok {
+		log.Debug("<router> House mode ", houseMode, " is not mapped to a Mill home mode")
+		return
+	}
+	mode, err := model.ParseHomeMode(modeName)
+	if err != nil {
+		log.Error("<router> Invalid mode_sync_map entry for ", houseMode, ": ", err)
+		fc.appLifecycle.SetError(model.AppErrorInvalidConfig, "Invalid mode_sync_map: "+err.Error())
+		return
+	}
+	accessToken, err := fc.tokens.AccessToken(fc.ctx)
+	if err != nil {
+		log.Info("<router> Can't follow house mode ", houseMode, ", error: ", err)
+		fc.appLifecycle.RecordError(err)
+		return
+	}
+	log.Info("<router> House mode changed to ", houseMode, ", setting Mill home mode ", modeName)
+	if err := fc.setHomeMode(accessToken, fc.states.Homes(), mode, fc.configs.GetModeSyncDuration()); err != nil {
+		fc.handleAPIError(err)
+		return
+	}
+	fc.appLifecycle.RecordAPIResult(nil)
+	fc.poller.Boost()
+}
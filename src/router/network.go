@@ -0,0 +1,151 @@
+package router
+
+import (
+	"strconv"
+
+	"github.com/futurehomeno/fimpgo"
+	"github.com/futurehomeno/fimpgo/fimptype"
+	log "github.com/sirupsen/logrus"
+	"github.com/thingsplex/mill/model"
+)
+
+func init() {
+	register(handler{service: model.ServiceName, msgType: "cmd.network.get_all_nodes", requiresAuth: true, state: stateFresh, handle: (*FromFimpRouter).networkGetAllNodes})
+	register(handler{service: model.ServiceName, msgType: "cmd.system.sync", requiresAuth: true, state: stateFresh, handle: (*FromFimpRouter).systemSync})
+	register(handler{service: model.ServiceName, msgType: "cmd.thing.get_inclusion_report", valueType: fimpgo.VTypeString, state: stateCached, handle: (*FromFimpRouter).thingGetInclusionReport})
+	register(handler{service: model.ServiceName, msgType: "cmd.thing.inclusion", handle: (*FromFimpRouter).thingInclusion})
+	register(handler{service: model.ServiceName, msgType: "cmd.thing.delete", valueType: fimpgo.VTypeStrMap, handle: (*FromFimpRouter).thingDelete})
+	register(handler{service: model.ServiceName, msgType: "cmd.app.uninstall", handle: (*FromFimpRouter).appUninstall})
+}
+
+type ListReportRecord struct {
+	Address        string `json:"address"`
+	Alias          string `json:"alias"`
+	WakeupInterval string `json:"wakeup_int"`
+	PowerSource    string `json:"power_source"`
+}
+
+func (fc *FromFimpRouter) networkGetAllNodes(req *request) {
+	// Homes, rooms and devices are refreshed by the router. Devices and rooms are sent back to fimp.
+	report := []ListReportRecord{}
+	devices := fc.states.Devices()
+	if len(devices) == 0 {
+		log.Info("There are no devices")
+		return
+	}
+	for _, device := range devices {
+		deviceID := strconv.FormatInt(device.DeviceID, 10)
+		rec := ListReportRecord{Address: deviceID, Alias: "Mill " + device.DeviceName, PowerSource: "ac", WakeupInterval: "-1"}
+		report = append(report, rec)
+	}
+	for _, room := range fc.states.Rooms() {
+		rec := ListReportRecord{Address: model.RoomAddress(room.RoomID), Alias: "Mill room " + room.RoomName, PowerSource: "ac", WakeupInterval: "-1"}
+		report = append(report, rec)
+	}
+
+	msg := fimpgo.NewMessage("evt.network.get_all_nodes_report", model.ServiceName, fimpgo.VTypeObject, report, nil, nil, req.msg.Payload)
+	msg.Source = "mill"
+	fc.respond(req.msg, msg)
+}
+
+// sendInclusionReports publishes inclusion reports for all devices and rooms
+func (fc *FromFimpRouter) sendInclusionReports(requestMsg *fimpgo.FimpMessage) {
+	ns := model.NewNetworkService(fc.configs)
+	for _, device := range fc.states.Devices() {
+		inclReport := ns.SendInclusionReport(device)
+
+		msg := fimpgo.NewMessage("evt.thing.inclusion_report", "mill", fimpgo.VTypeObject, inclReport, nil, nil, requestMsg)
+		fc.mqt.Publish(adapterAddress(), msg)
+	}
+	for _, room := range fc.states.Rooms() {
+		inclReport := ns.SendRoomInclusionReport(room)
+
+		msg := fimpgo.NewMessage("evt.thing.inclusion_report", "mill", fimpgo.VTypeObject, inclReport, nil, nil, requestMsg)
+		fc.mqt.Publish(adapterAddress(), msg)
+	}
+}
+
+// sendExclusionReports publishes exclusion reports for all devices and rooms
+func (fc *FromFimpRouter) sendExclusionReports(requestMsg *fimpgo.FimpMessage) {
+	addresses := []string{}
+	for _, device := range fc.states.Devices() {
+		addresses = append(addresses, strconv.FormatInt(device.DeviceID, 10))
+	}
+	for _, room := range fc.states.Rooms() {
+		addresses = append(addresses, model.RoomAddress(room.RoomID))
+	}
+	for _, addr := range addresses {
+		val := map[string]interface{}{
+			"address": addr,
+		}
+		msg := fimpgo.NewMessage("evt.thing.exclusion_report", "mill", fimpgo.VTypeObject, val, nil, nil, requestMsg)
+		fc.mqt.Publish(adapterAddress(), msg)
+	}
+}
+
+func (fc *FromFimpRouter) systemSync(req *request) {
+	fc.sendInclusionReports(req.msg.Payload)
+
+	val2 := model.ButtonActionResponse{
+		Operation:       "cmd.system.sync",
+		OperationStatus: "ok",
+		Next:            "reload",
+		ErrorCode:       "",
+		ErrorText:       "",
+	}
+
+	msg := fimpgo.NewMessage("evt.app.config_action_report", model.ServiceName, fimpgo.VTypeObject, val2, nil, nil, req.msg.Payload)
+	if err := fc.mqt.RespondToRequest(req.msg.Payload, msg); err != nil {
+		log.Error("Could not respond to wanted request")
+	}
+	log.Info("All devices synced")
+}
+
+func (fc *FromFimpRouter) thingGetInclusionReport(req *request) {
+	ns := model.NewNetworkService(fc.configs)
+	deviceID, err := req.msg.Payload.GetStringValue()
+	if err != nil {
+		// handle err
+		log.Error("Can't get strValue, error: ", err)
+	}
+	var inclReport fimptype.ThingInclusionReport
+	if room, ok := fc.states.RoomByAddress(deviceID); ok {
+		inclReport = ns.SendRoomInclusionReport(room)
+	} else if device, ok := fc.states.DeviceByAddress(deviceID); ok {
+		inclReport = ns.SendInclusionReport(device)
+	} else {
+		log.Error("Device with deviceID: ", deviceID, " not found")
+		return
+	}
+
+	msg := fimpgo.NewMessage("evt.thing.inclusion_report", "mill", fimpgo.VTypeObject, inclReport, nil, nil, nil)
+	fc.mqt.Publish(adapterAddress(), msg)
+}
+
+func (fc *FromFimpRouter) thingInclusion(req *request) {
+	//flag , _ := newMsg.Payload.GetBoolValue()
+	// TODO: This is an example . Add your logic here or remove
+}
+
+func (fc *FromFimpRouter) thingDelete(req *request) {
+	// remove device from network
+	val, err := req.msg.Payload.GetStrMapValue()
+	if err != nil {
+		log.Error("Wrong msg format")
+		return
+	}
+	deviceID := val["address"]
+	_, isRoom := fc.states.RoomByAddress(deviceID)
+	if _, ok := fc.states.DeviceByAddress(deviceID); ok || isRoom {
+		val := map[string]interface{}{
+			"address": deviceID,
+		}
+		msg := fimpgo.NewMessage("evt.thing.exclusion_report", "mill", fimpgo.VTypeObject, val, nil, nil, req.msg.Payload)
+		fc.mqt.Publish(adapterAddress(), msg)
+		log.Info("Device with deviceID: ", deviceID, " has been removed from network.")
+	}
+}
+
+func (fc *FromFimpRouter) appUninstall(req *request) {
+	fc.sendExclusionReports(req.msg.Payload)
+}
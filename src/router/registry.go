@@ -0,0 +1,89 @@
+package router
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/futurehomeno/fimpgo"
+	mill "github.com/thingsplex/mill/millapi"
+)
+
+// Error codes sent in evt.error.report when a message is rejected
+const (
+	ErrCodeUnknownCommand   = "unknown_command"
+	ErrCodeInvalidValueType = "invalid_value_type"
+	ErrCodeNotAuthenticated = "not_authenticated"
+	ErrCodeUnknownDevice    = "unknown_device"
+	ErrCodeInvalidValue     = "invalid_value"
+	ErrCodeSetpointLocked   = "setpoint_locked"
+	ErrCodeOutOfRange       = "out_of_range"
+	ErrCodeNoSetpoint       = "no_setpoint"
+)
+
+// request is a validated FIMP message passed to a handler
+type request struct {
+	msg         *fimpgo.Message
+	addr        string      // service address without FIMP suffixes, the Mill device id or a room address for device services
+	device      mill.Device // set if the handler requires an address and the message is addressed to a device
+	room        mill.Room   // set if the message is addressed to a room, see handleRoom
+	accessToken string      // set if the handler requires auth or state, empty if not logged in
+}
+
+// stateNeed tells the router how fresh the cached homes, rooms and devices must be before a handler runs
+type stateNeed int
+
+const (
+	stateNone   stateNeed = iota // the handler doesn't read devices, or only needs whatever is cached
+	stateCached                  // refreshed from Mill when older than cache_max_age_sec
+	stateFresh                   // refreshed from Mill when older than fresh_max_age_sec
+)
+
+// handler describes how one FIMP message type of one service is handled.
+// The router checks the metadata before handle is called, and answers with evt.error.report if a check fails.
+type handler struct {
+	service         string
+	msgType         string // empty matches all message types of the service
+	valueType       string // expected payload value type, empty accepts any
+	requiresAuth    bool   // the adapter must have a Mill access token
+	requiresAddress bool   // the message must be addressed to a known device, or to a known room if handleRoom is set
+	state           stateNeed
+	handle          func(fc *FromFimpRouter, req *request)
+	handleRoom      func(fc *FromFimpRouter, req *request) // handles messages addressed to rooms, nil if rooms don't support the message
+}
+
+type handlerKey struct {
+	service string
+	msgType string
+}
+
+var handlers = map[handlerKey]handler{}
+
+// register adds a handler to the registry. Handlers register themselves from init in their own file.
+func register(h handler) {
+	key := handlerKey{service: h.service, msgType: h.msgType}
+	if _, exists := handlers[key]; exists {
+		panic(fmt.Sprintf("router: duplicate handler for %s %s", h.service, h.msgType))
+	}
+	handlers[key] = h
+}
+
+// lookupHandler returns the handler for a message, falling back to a handler for all types of the service
+func lookupHandler(service, msgType string) (handler, bool) {
+	if h, ok := handlers[handlerKey{service: service, msgType: msgType}]; ok {
+		return h, true
+	}
+	h, ok := handlers[handlerKey{service: service}]
+	return h, ok
+}
+
+// isCommand reports whether a message type is a command. Only commands are answered when they can't be handled,
+// events on the subscribed topics include the adapter's own reports.
+func isCommand(msgType string) bool {
+	return strings.HasPrefix(msgType, "cmd.")
+}
+
+// deviceAddress strips the FIMP suffixes from a service address
+func deviceAddress(msg *fimpgo.Message) string {
+	addr := strings.Replace(msg.Addr.ServiceAddress, "_0", "", 1)
+	return strings.Replace(addr, "l", "", 1)
+}
@@ -0,0 +1,86 @@
+package router
+
+import (
+	"fmt"
+
+	"github.com/futurehomeno/fimpgo"
+	log "github.com/sirupsen/logrus"
+	mill "github.com/thingsplex/mill/millapi"
+	"github.com/thingsplex/mill/model"
+)
+
+// Rooms are FIMP things addressed by model.RoomAddress. Their handlers are registered together with the
+// heater handlers of the same service, see handler.handleRoom.
+
+func (fc *FromFimpRouter) roomSetpointSet(req *request) {
+	val, _ := req.msg.Payload.GetStrMapValue()
+	setpointType, newTemp, err := parseSetpoint(val)
+	if err != nil {
+		fc.replyError(req.msg, ErrCodeInvalidValue, err.Error())
+		return
+	}
+	if minTemp, maxTemp := fc.configs.GetRoomSetpointRange(req.room); newTemp < minTemp || newTemp > maxTemp {
+		fc.replyError(req.msg, ErrCodeOutOfRange, fmt.Sprintf("setpoint %s is outside the allowed range %s-%s C of room %s", mill.FormatTemp(newTemp), mill.FormatTemp(minTemp), mill.FormatTemp(maxTemp), req.addr))
+		return
+	}
+	// Mill takes whole degrees for rooms
+	applied := mill.RoundSetpoint(newTemp, 1)
+	comfortTemp, sleepTemp, awayTemp, ok := model.WithRoomSetpoint(req.room, setpointType, int(applied))
+	if !ok {
+		fc.replyError(req.msg, ErrCodeInvalidValue, fmt.Sprintf("setpoint type %q is not supported by rooms, only %v", setpointType, model.RoomSetpointTypes))
+		return
+	}
+
+	if err := fc.client.RoomTempControl(fc.ctx, req.accessToken, req.room.RoomID, comfortTemp, sleepTemp, awayTemp); err == nil {
+		report := map[string]string{"type": setpointType, "temp": mill.FormatTemp(applied), "unit": "C"}
+		var props fimpgo.Props
+		if applied != newTemp {
+			props = fimpgo.Props{"rounded": "true", "requested_temp": mill.FormatTemp(newTemp)}
+			log.Warnf("Setpoint %s rounded to %s, rooms accept whole degrees", mill.FormatTemp(newTemp), report["temp"])
+		}
+		msg := fimpgo.NewMessage("evt.setpoint.report", "thermostat", fimpgo.VTypeStrMap, report, props, nil, req.msg.Payload)
+		fc.mqt.Publish(thermostatAddress(req.addr), msg)
+		log.Info("Room ", req.addr, " ", setpointType, " setpoint updated, new setpoint ", report["temp"])
+		fc.poller.Boost()
+		fc.appLifecycle.RecordAPIResult(nil)
+	} else {
+		log.Error("Can't change room temperature, error: ", err)
+		fc.replyAPIError(req.msg, err)
+	}
+}
+
+// roomSetpointGetReport reports the setpoint of the requested type, or all setpoints if no type is given
+func (fc *FromFimpRouter) roomSetpointGetReport(req *request) {
+	setpointType, _ := req.msg.Payload.GetStringValue()
+	setpoints := model.RoomSetpoints(req.room)
+	if _, ok := setpoints[setpointType]; setpointType != "" && !ok {
+		fc.replyError(req.msg, ErrCodeInvalidValue, fmt.Sprintf("setpoint type %q is not supported by rooms, only %v", setpointType, model.RoomSetpointTypes))
+		return
+	}
+	for _, t := range model.RoomSetpointTypes {
+		if setpointType != "" && t != setpointType {
+			continue
+		}
+		val := map[string]interface{}{
+			"type": t,
+			"temp": mill.FormatTemp(setpoints[t]),
+			"unit": "C",
+		}
+		msg := fimpgo.NewMessage("evt.setpoint.report", "thermostat", fimpgo.VTypeStrMap, val, nil, nil, req.msg.Payload)
+		fc.mqt.Publish(thermostatAddress(req.addr), msg)
+	}
+}
+
+func (fc *FromFimpRouter) roomModeGetReport(req *request) {
+	msg := fimpgo.NewMessage("evt.mode.report", "thermostat", fimpgo.VTypeString, model.RoomMode(req.room), nil, nil, req.msg.Payload)
+	fc.mqt.Publish(thermostatAddress(req.addr), msg)
+}
+
+func (fc *FromFimpRouter) roomSensorGetReport(req *request) {
+	props := fimpgo.Props{}
+	props["unit"] = "C"
+
+	adr := &fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeDevice, ResourceName: model.ServiceName, ResourceAddress: "1", ServiceName: "sensor_temp", ServiceAddress: req.addr}
+	msg := fimpgo.NewMessage("evt.sensor.report", "sensor_temp", fimpgo.VTypeFloat, float64(req.room.AvgTemp), props, nil, req.msg.Payload)
+	fc.mqt.Publish(adr, msg)
+}
@@ -0,0 +1,20 @@
+package router
+
+import (
+	"github.com/futurehomeno/fimpgo"
+	"github.com/thingsplex/mill/model"
+)
+
+func init() {
+	register(handler{service: "sensor_temp", msgType: "cmd.sensor.get_report", requiresAddress: true, state: stateCached, handle: (*FromFimpRouter).sensorGetReport, handleRoom: (*FromFimpRouter).roomSensorGetReport})
+}
+
+func (fc *FromFimpRouter) sensorGetReport(req *request) {
+	val := req.device.CurrentTemp
+	props := fimpgo.Props{}
+	props["unit"] = "C"
+
+	adr := &fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeDevice, ResourceName: model.ServiceName, ResourceAddress: "1", ServiceName: "sensor_temp", ServiceAddress: req.addr}
+	msg := fimpgo.NewMessage("evt.sensor.report", "sensor_temp", fimpgo.VTypeFloat, val, props, nil, req.msg.Payload)
+	fc.mqt.Publish(adr, msg)
+}
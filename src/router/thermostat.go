@@ -0,0 +1,132 @@
+package router
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/futurehomeno/fimpgo"
+	log "github.com/sirupsen/logrus"
+	mill "github.com/thingsplex/mill/millapi"
+	"github.com/thingsplex/mill/model"
+)
+
+func init() {
+	register(handler{service: "thermostat", msgType: "cmd.setpoint.set", valueType: fimpgo.VTypeStrMap, requiresAuth: true, requiresAddress: true, state: stateCached, handle: (*FromFimpRouter).setpointSet, handleRoom: (*FromFimpRouter).roomSetpointSet})
+	register(handler{service: "thermostat", msgType: "cmd.setpoint.get_report", requiresAddress: true, state: stateCached, handle: (*FromFimpRouter).setpointGetReport, handleRoom: (*FromFimpRouter).roomSetpointGetReport})
+	register(handler{service: "thermostat", msgType: "cmd.mode.set", valueType: fimpgo.VTypeString, requiresAuth: true, requiresAddress: true, state: stateCached, handle: (*FromFimpRouter).modeSet})
+	register(handler{service: "thermostat", msgType: "cmd.mode.get_report", requiresAddress: true, state: stateCached, handle: (*FromFimpRouter).modeGetReport, handleRoom: (*FromFimpRouter).roomModeGetReport})
+}
+
+func thermostatAddress(addr string) *fimpgo.Address {
+	return &fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeDevice, ResourceName: model.ServiceName, ResourceAddress: "1", ServiceName: "thermostat", ServiceAddress: addr}
+}
+
+// parseSetpoint reads the setpoint type and temperature of a cmd.setpoint.set value, e.g. {"type":"heat", "temp":"21.5", "unit":"C"}.
+// A missing type is heat.
+func parseSetpoint(val map[string]string) (string, float64, error) {
+	setpointType := val["type"]
+	if setpointType == "" {
+		setpointType = "heat"
+	}
+	if unit := val["unit"]; unit != "" && unit != "C" {
+		return "", 0, fmt.Errorf("unit %q is not supported, only C", unit)
+	}
+	temp, err := strconv.ParseFloat(val["temp"], 64)
+	if err != nil || math.IsNaN(temp) || math.IsInf(temp, 0) {
+		return "", 0, fmt.Errorf("temp %q is not a number", val["temp"])
+	}
+	return setpointType, temp, nil
+}
+
+func (fc *FromFimpRouter) setpointSet(req *request) {
+	val, _ := req.msg.Payload.GetStrMapValue()
+	setpointType, newTemp, err := parseSetpoint(val)
+	if err == nil && setpointType != "heat" {
+		err = fmt.Errorf("setpoint type %q is not supported, only heat", setpointType)
+	}
+	if err != nil {
+		fc.replyError(req.msg, ErrCodeInvalidValue, err.Error())
+		return
+	}
+	if !req.device.CanSetTemp() {
+		fc.replyError(req.msg, ErrCodeSetpointLocked, fmt.Sprintf("Mill doesn't allow setpoint changes on device %s", req.addr))
+		return
+	}
+	if minTemp, maxTemp := fc.configs.GetSetpointRange(req.device); newTemp < minTemp || newTemp > maxTemp {
+		fc.replyError(req.msg, ErrCodeOutOfRange, fmt.Sprintf("setpoint %s is outside the allowed range %s-%s C of device %s", mill.FormatTemp(newTemp), mill.FormatTemp(minTemp), mill.FormatTemp(maxTemp), req.addr))
+		return
+	}
+
+	if applied, err := fc.client.TempControl(fc.ctx, req.accessToken, req.device, newTemp); err == nil {
+		report := map[string]string{"type": "heat", "temp": mill.FormatTemp(applied), "unit": "C"}
+		var props fimpgo.Props
+		if applied != newTemp {
+			// the device model doesn't support the requested resolution
+			props = fimpgo.Props{"rounded": "true", "requested_temp": mill.FormatTemp(newTemp)}
+			log.Warnf("Setpoint %s rounded to %s, device %s accepts steps of %s C", mill.FormatTemp(newTemp), report["temp"], req.addr, mill.FormatTemp(fc.client.SetpointResolution(req.device)))
+		}
+		msg := fimpgo.NewMessage("evt.setpoint.report", "thermostat", fimpgo.VTypeStrMap, report, props, nil, req.msg.Payload)
+		fc.mqt.Publish(thermostatAddress(req.addr), msg)
+		log.Info("Temperature setpoint updated, new setpoint ", report["temp"])
+		fc.poller.Boost()
+		fc.appLifecycle.RecordAPIResult(nil)
+	} else {
+		log.Error("Can't change temperature, error: ", err)
+		fc.replyAPIError(req.msg, err)
+	}
+}
+
+func (fc *FromFimpRouter) setpointGetReport(req *request) {
+	setpointTemp, ok := fc.states.EffectiveSetpoint(req.device)
+	if !ok {
+		fc.replyError(req.msg, ErrCodeNoSetpoint, fmt.Sprintf("device %s has no known setpoint, its room is off or follows the weekly program", req.addr))
+		return
+	}
+	val := map[string]interface{}{
+		"type": "heat",
+		"temp": mill.FormatTemp(setpointTemp),
+		"unit": "C",
+	}
+	msg := fimpgo.NewMessage("evt.setpoint.report", "thermostat", fimpgo.VTypeStrMap, val, nil, nil, req.msg.Payload)
+	fc.mqt.Publish(thermostatAddress(req.addr), msg)
+}
+
+func (fc *FromFimpRouter) modeSet(req *request) {
+	val, _ := req.msg.Payload.GetStringValue()
+	log.Debug("Trying to set new mode: ", val)
+	if !model.IsThermostatMode(val) {
+		fc.replyError(req.msg, ErrCodeInvalidValue, fmt.Sprintf("mode %q is not supported, only %v", val, model.ThermostatModes))
+		return
+	}
+
+	// Mill needs a hold temperature with every mode change, keep the one the device heats to now.
+	// Without a known setpoint, e.g. in a room on the weekly program, the lowest setpoint of the device is used.
+	minTemp, maxTemp := fc.configs.GetSetpointRange(req.device)
+	holdTemp, ok := fc.states.EffectiveSetpoint(req.device)
+	if !ok || holdTemp < minTemp {
+		holdTemp = minTemp
+	} else if holdTemp > maxTemp {
+		holdTemp = maxTemp
+	}
+	log.Debug("setpointTemp: ", holdTemp)
+
+	if _, err := fc.client.ModeControl(fc.ctx, req.accessToken, req.device, holdTemp, val); err == nil {
+		msg := fimpgo.NewMessage("evt.mode.report", "thermostat", fimpgo.VTypeString, val, nil, nil, req.msg.Payload)
+		fc.mqt.Publish(thermostatAddress(req.addr), msg)
+		log.Info("Mode updated, new mode: ", val)
+		fc.poller.Boost()
+		fc.appLifecycle.RecordAPIResult(nil)
+	} else {
+		log.Error("Can't change mode, error: ", err)
+		fc.replyAPIError(req.msg, err)
+	}
+}
+
+func (fc *FromFimpRouter) modeGetReport(req *request) {
+	// Do we need this? Will/should allways be heat
+	val := "heat"
+
+	msg := fimpgo.NewMessage("evt.mode.report", "thermostat", fimpgo.VTypeString, val, nil, nil, req.msg.Payload)
+	fc.mqt.Publish(thermostatAddress(req.addr), msg)
+}
@@ -1,10 +1,14 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
-	"reflect"
+	"os"
+	"os/signal"
 	"strconv"
+	"syscall"
 	"time"
 
 	"github.com/futurehomeno/fimpgo"
@@ -17,6 +21,9 @@ import (
 	"github.com/thingsplex/mill/utils"
 )
 
+// shutdownTimeout bounds how long flushing files and stopping the transports may take after SIGTERM
+const shutdownTimeout = 10 * time.Second
+
 func main() {
 	var workDir string
 	flag.StringVar(&workDir, "c", "", "Work dir")
@@ -39,12 +46,32 @@ func main() {
 		fmt.Print(err)
 		panic("Can't load state file.")
 	}
-	client := mill.Client{}
-	config := mill.Config{}
+	// ctx is canceled on SIGTERM, which stops the poller, the token manager and in-flight Mill API calls
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		sig := <-signals
+		log.Info("<main> Received signal ", sig, ", shutting down")
+		appLifecycle.SetAppState(model.AppStateTerminate, "received "+sig.String())
+		cancel()
+	}()
 
 	utils.SetupLog(configs.LogFile, configs.LogLevel, configs.LogFormat)
 	log.Info("--------------Starting mill----------------")
 	log.Info("Work directory : ", configs.WorkDir)
+	log.Infof("Api profile : %s , mill api : %s , partner api : %s", configs.GetAPIProfile(), configs.GetMillAPIURL(), configs.GetPartnerAPIURL())
+	connectivity := model.NewConnectivityMonitor(appLifecycle)
+	client := newMillClient(configs, func(endpoint string, err error) {
+		if endpoint == mill.EndpointPartnerAuthCode {
+			// the Futurehome partner api says nothing about the Mill cloud, its failures show up as a failed login
+			return
+		}
+		appLifecycle.RecordError(err)
+		connectivity.Record(endpoint, err)
+	})
+	tokens := model.NewTokenManager(client, configs, appLifecycle, connectivity)
 	appLifecycle.PublishEvent(model.EventConfiguring, "main", nil)
 
 	mqtt := fimpgo.NewMqttTransport(configs.MqttServerURI, configs.MqttClientIdPrefix, configs.MqttUsername, configs.MqttPassword, true, 1, 1)
@@ -53,27 +80,45 @@ func main() {
 	responder.RegisterResource(model.GetDiscoveryResource())
 	responder.Start()
 
-	fimpRouter := router.NewFromFimpRouter(mqtt, appLifecycle, configs, states)
-	fimpRouter.Start()
+	tokens.SetExpiryNotifier(func(status model.AuthStatus) {
+		adr := &fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeAdapter, ResourceName: model.ServiceName, ResourceAddress: "1"}
+		msg := fimpgo.NewMessage("evt.auth.status_report", model.ServiceName, fimpgo.VTypeObject, status, nil, nil, nil)
+		mqtt.Publish(adr, msg)
+	})
+	tokens.Start(ctx)
+	appLifecycle.SetErrorNotifier(func(appErr model.AppError) {
+		adr := &fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeAdapter, ResourceName: model.ServiceName, ResourceAddress: "1"}
+		msg := fimpgo.NewMessage("evt.app.error_report", model.ServiceName, fimpgo.VTypeObject, appErr, nil, nil, nil)
+		mqtt.Publish(adr, msg)
+	})
+
+	poller := model.NewPollScheduler(configs)
+	fimpRouter := router.NewFromFimpRouter(mqtt, appLifecycle, configs, states, client, tokens, poller, connectivity)
+	fimpRouter.Start(ctx)
 
-	appLifecycle.SetConnectionState(model.ConnStateDisconnected)
+	// the connection state follows the results of Mill API requests from here on
+	connectivity.SetNotifier(func(state model.State) {
+		adr := &fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeAdapter, ResourceName: model.ServiceName, ResourceAddress: "1"}
+		msg := fimpgo.NewMessage("evt.app.state_report", model.ServiceName, fimpgo.VTypeObject, appLifecycle.GetAllStates(), nil, nil, nil)
+		mqtt.Publish(adr, msg)
+	})
 	if configs.IsConfigured() && err == nil {
-		appLifecycle.SetConfigState(model.ConfigStateConfigured)
-		appLifecycle.SetAppState(model.AppStateRunning, nil)
-		appLifecycle.SetConnectionState(model.ConnStateConnected)
+		appLifecycle.SetConfigState(model.ConfigStateConfigured, "startup")
+		appLifecycle.SetAppState(model.AppStateRunning, "startup, configured")
+		connectivity.Connecting("startup")
 	} else {
-		appLifecycle.SetConfigState(model.ConfigStateNotConfigured)
-		appLifecycle.SetAppState(model.AppStateNotConfigured, nil)
-		appLifecycle.SetConnectionState(model.ConnStateDisconnected)
+		appLifecycle.SetConfigState(model.ConfigStateNotConfigured, "startup")
+		appLifecycle.SetAppState(model.AppStateNotConfigured, "startup, not configured")
+		connectivity.Disconnected("startup, not configured")
 	}
 
 	if configs.IsAuthenticated() && err == nil {
-		appLifecycle.SetAuthState(model.AuthStateAuthenticated)
+		appLifecycle.SetAuthState(model.AuthStateAuthenticated, "startup")
 	} else {
-		appLifecycle.SetAuthState(model.AuthStateNotAuthenticated)
+		appLifecycle.SetAuthState(model.AuthStateNotAuthenticated, "startup")
 	}
 	//------------------ Sample code --------------------------------------
-	if err := edgeapp.NewSystemCheck().WaitForInternet(5 * time.Minute); err == nil {
+	if err := waitForInternet(ctx, 5*time.Minute); err == nil {
 		log.Info("<main> Internet connection - OK")
 	} else {
 		log.Error("<main> Internet connection - ERROR")
@@ -84,73 +129,172 @@ func main() {
 	} else {
 		log.Info("Connected")
 	}
-	appLifecycle.SetAppState(model.AppStateRunning, nil)
 	//------------------ Sample code --------------------------------------
-	PollString := configs.PollTimeMin
-	PollTime, err := strconv.Atoi(PollString)
-	for {
-		appLifecycle.WaitForState("main", model.AppStateRunning)
-		log.Info("Starting ticker")
-		ticker := time.NewTicker(time.Duration(PollTime) * time.Minute)
-		for ; true; <-ticker.C {
-			if configs.Auth.ExpireTime != 0 {
-				log.Debug("Checking expireTime")
-				millis := time.Now().UnixNano() / 1000000
-				if millis > configs.Auth.ExpireTime && millis < configs.Auth.RefreshExpireTime {
-					log.Debug("Trying to set new tokens")
-					accessToken, refreshToken, expireTime, refreshExpireTime, err := config.RefreshToken(configs.Auth.RefreshToken)
-					log.Debug(err)
-					if err == nil {
-						configs.Auth.AccessToken = accessToken
-						configs.Auth.RefreshToken = refreshToken
-						configs.Auth.ExpireTime = expireTime
-						configs.Auth.RefreshExpireTime = refreshExpireTime
-						appLifecycle.SetConnectionState(model.ConnStateConnected)
-					} else {
-						configs.Auth.ExpireTime = 1
-						appLifecycle.SetConnectionState(model.ConnStateDisconnected)
-					}
-					states.SaveToFile()
-					configs.SaveToFile()
-				} else if millis > configs.Auth.RefreshExpireTime {
-					log.Error("30 day refreshExpireTime has expired. Restard adapter or send cmd.auth.login")
-				} else {
-					log.Debug("expiretime is OK")
+	// the poller only publishes values which changed, or are due for a heartbeat
+	reports := model.NewReportFilter(configs)
+	if _, err := model.ParsePollTime(configs.GetPollTimeMin()); err != nil {
+		log.Warnf("Invalid poll time: %s. Polling every %s", err, configs.GetPollInterval())
+		appLifecycle.SetError(model.AppErrorInvalidConfig, "Invalid poll time: "+err.Error())
+	}
+	for ctx.Err() == nil {
+		if !appLifecycle.WaitForStateContext(ctx, "main", model.AppStateRunning) {
+			break
+		}
+		log.Info("Starting poller")
+		// polling stops when the app leaves RUNNING, e.g. after logout or factory reset
+		for poller.Wait(ctx) && appLifecycle.AppState() == model.AppStateRunning {
+			accessToken, err := tokens.AccessToken(ctx)
+			if err != nil {
+				if !errors.Is(err, model.ErrNotAuthenticated) {
+					log.Error("Can't get access token, error: ", err)
+					poller.Failure()
 				}
+				continue
 			}
-			states.DeviceCollection, states.RoomCollection, states.HomeCollection, states.IndependentDeviceCollection = nil, nil, nil, nil
-			states.HomeCollection, states.RoomCollection, states.DeviceCollection, states.IndependentDeviceCollection = client.UpdateLists(configs.Auth.AccessToken, states.HomeCollection, states.RoomCollection, states.DeviceCollection, states.IndependentDeviceCollection)
-
-			for i := 0; i < len(states.DeviceCollection); i++ {
-				device := reflect.ValueOf(states.DeviceCollection[i])
-				deviceId := strconv.FormatInt(device.FieldByName("DeviceID").Interface().(int64), 10)
-				currentTemp := device.FieldByName("CurrentTemp").Interface().(float32)
-				tempVal := currentTemp
+			inv, err := client.GetAllDevices(ctx, accessToken)
+			if err == nil {
+				err = inv.Err()
+				// homes which failed keep their cached devices
+				states.Update(inv)
+			}
+			if err != nil {
+				log.Error("Can't update device lists, error: ", err)
+				if errors.Is(err, mill.ErrTokenExpired) {
+					// refresh on the next tick instead of waiting for expireTime
+					tokens.Invalidate()
+				}
+				poller.Failure()
+				log.Info("Next poll in ", poller.Interval())
+			} else {
+				poller.Success()
+			}
+			appLifecycle.RecordAPIResult(err)
+
+			for _, device := range states.Devices() {
+				deviceId := strconv.FormatInt(device.DeviceID, 10)
+				tempVal := device.CurrentTemp
 				props := fimpgo.Props{}
 				props["unit"] = "C"
 
-				adr := &fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeDevice, ResourceName: model.ServiceName, ResourceAddress: "1", ServiceName: "sensor_temp", ServiceAddress: deviceId}
-				msg := fimpgo.NewMessage("evt.sensor.report", "sensor_temp", fimpgo.VTypeFloat, tempVal, props, nil, nil)
-				mqtt.Publish(adr, msg)
+				if reports.ShouldReport(deviceId, "sensor_temp", float64(tempVal), configs.ReportTempDelta) {
+					adr := &fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeDevice, ResourceName: model.ServiceName, ResourceAddress: "1", ServiceName: "sensor_temp", ServiceAddress: deviceId}
+					msg := fimpgo.NewMessage("evt.sensor.report", "sensor_temp", fimpgo.VTypeFloat, tempVal, props, nil, nil)
+					mqtt.Publish(adr, msg)
+				}
 
-				setpointTemp := strconv.FormatInt(device.FieldByName("SetpointTemp").Interface().(int64), 10)
+				setpointTemp, ok := states.EffectiveSetpoint(device)
 				setpointVal := map[string]interface{}{
 					"type": "heat",
-					"temp": setpointTemp,
+					"temp": mill.FormatTemp(setpointTemp),
 					"unit": "C",
 				}
-				if setpointTemp != "0" {
-					adr = &fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeDevice, ResourceName: model.ServiceName, ResourceAddress: "1", ServiceName: "thermostat", ServiceAddress: deviceId}
-					msg = fimpgo.NewMessage("evt.setpoint.report", "thermostat", fimpgo.VTypeStrMap, setpointVal, nil, nil, nil)
+				if ok && reports.ShouldReport(deviceId, "thermostat", setpointTemp, 0) {
+					adr := &fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeDevice, ResourceName: model.ServiceName, ResourceAddress: "1", ServiceName: "thermostat", ServiceAddress: deviceId}
+					msg := fimpgo.NewMessage("evt.setpoint.report", "thermostat", fimpgo.VTypeStrMap, setpointVal, nil, nil, nil)
 					mqtt.Publish(adr, msg)
 				}
 				// -----------------------------------------------------------------------------------------------
 			}
+			for _, room := range states.Rooms() {
+				publishRoomReports(mqtt, reports, configs, room)
+			}
 			states.SaveToFile()
 		}
-		appLifecycle.WaitForState(model.AppStateNotConfigured, "main")
+		log.Info("Poller stopped, app state = ", appLifecycle.AppState())
 	}
 
-	mqtt.Stop()
-	time.Sleep(5 * time.Second)
+	shutdown(mqtt, responder, fimpRouter, appLifecycle, configs, states)
+}
+
+// waitForInternet is edgeapp.SystemCheck.WaitForInternet, but returns ctx.Err() as soon as ctx is done,
+// so SIGTERM during startup doesn't wait for the timeout
+func waitForInternet(ctx context.Context, timeout time.Duration) error {
+	check := edgeapp.NewSystemCheck()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for !check.IsInternetAvailable() {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+			return errors.New("timeout")
+		case <-time.After(5 * time.Second):
+		}
+	}
+	return nil
+}
+
+// shutdown waits for the router to finish the message being handled, flushes state and config to disk,
+// publishes the final app state and stops the transports.
+// It gives up after shutdownTimeout, so a hanging broker connection can't block the exit.
+func shutdown(mqtt *fimpgo.MqttTransport, responder *discovery.ServiceDiscoveryResponder, fimpRouter *router.FromFimpRouter, appLifecycle *model.Lifecycle, configs *model.Configs, states *model.States) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// the router writes configs and states while handling messages, so it must stop before the final flush
+		fimpRouter.Wait()
+		if err := states.SaveToFile(); err != nil {
+			log.Error("<main> Can't save state file, error: ", err)
+		}
+		if err := configs.SaveToFile(); err != nil {
+			log.Error("<main> Can't save config file, error: ", err)
+		}
+		adr := &fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeAdapter, ResourceName: model.ServiceName, ResourceAddress: "1"}
+		msg := fimpgo.NewMessage("evt.app.state_report", model.ServiceName, fimpgo.VTypeObject, appLifecycle.GetAllStates(), nil, nil, nil)
+		if err := mqtt.PublishSync(adr, msg); err != nil {
+			log.Error("<main> Can't publish final app state, error: ", err)
+		}
+		responder.Stop()
+		mqtt.Stop()
+	}()
+	select {
+	case <-done:
+		log.Info("<main> Shutdown complete")
+	case <-time.After(shutdownTimeout):
+		log.Error("<main> Shutdown timed out after ", shutdownTimeout)
+	}
+}
+
+// publishRoomReports publishes the average temperature, setpoints and mode of a room when they changed
+func publishRoomReports(mqtt *fimpgo.MqttTransport, reports *model.ReportFilter, configs *model.Configs, room mill.Room) {
+	roomAddr := model.RoomAddress(room.RoomID)
+	if reports.ShouldReport(roomAddr, "sensor_temp", float64(room.AvgTemp), configs.ReportTempDelta) {
+		adr := &fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeDevice, ResourceName: model.ServiceName, ResourceAddress: "1", ServiceName: "sensor_temp", ServiceAddress: roomAddr}
+		msg := fimpgo.NewMessage("evt.sensor.report", "sensor_temp", fimpgo.VTypeFloat, float64(room.AvgTemp), fimpgo.Props{"unit": "C"}, nil, nil)
+		mqtt.Publish(adr, msg)
+	}
+
+	adr := &fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeDevice, ResourceName: model.ServiceName, ResourceAddress: "1", ServiceName: "thermostat", ServiceAddress: roomAddr}
+	setpoints := model.RoomSetpoints(room)
+	for _, setpointType := range model.RoomSetpointTypes {
+		if !reports.ShouldReport(roomAddr, "thermostat_"+setpointType, setpoints[setpointType], 0) {
+			continue
+		}
+		setpointVal := map[string]interface{}{
+			"type": setpointType,
+			"temp": mill.FormatTemp(setpoints[setpointType]),
+			"unit": "C",
+		}
+		msg := fimpgo.NewMessage("evt.setpoint.report", "thermostat", fimpgo.VTypeStrMap, setpointVal, nil, nil, nil)
+		mqtt.Publish(adr, msg)
+	}
+	if reports.ShouldReport(roomAddr, "thermostat_mode", float64(room.CurrentMode), 0) {
+		msg := fimpgo.NewMessage("evt.mode.report", "thermostat", fimpgo.VTypeString, model.RoomMode(room), nil, nil, nil)
+		mqtt.Publish(adr, msg)
+	}
+}
+
+// newMillClient creates a Mill API client for the api profile in configs. observer is called with the result of every request.
+func newMillClient(configs *model.Configs, observer func(endpoint string, err error)) *mill.Client {
+	retryPolicy := mill.DefaultRetryPolicy
+	if configs.APIMaxAttempts > 0 {
+		retryPolicy.MaxAttempts = configs.APIMaxAttempts
+	}
+	return mill.New(
+		mill.WithBaseURL(configs.GetMillAPIURL()),
+		mill.WithPartnerURL(configs.GetPartnerAPIURL()),
+		mill.WithRetryPolicy(retryPolicy),
+		mill.WithRequestObserver(observer),
+		mill.WithSetpointResolutions(configs.GetSetpointResolutions()),
+	)
 }